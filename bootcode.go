@@ -0,0 +1,119 @@
+package spicy
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/trhodeos/ecoff"
+)
+
+// BootCodeStart is the rom offset the boot code (IPL3) is loaded at.
+const BootCodeStart = headerSize
+
+// BootCodeSize is the exact size of the boot code region.
+const BootCodeSize = bootCodeSize
+
+// Magic numbers of big-endian MIPS ECOFF files.
+var ecoffMagics = map[uint16]bool{
+	0x0160: true,
+	0x0163: true,
+	0x0166: true,
+}
+
+// readCode returns the .text section of an ELF or ECOFF file, or the whole
+// file if it is neither. isObject reports which it was.
+func readCode(r io.Reader) (code []byte, isObject bool, err error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, false, err
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte(elf.ELFMAG)):
+		code, err = elfText(data)
+		return code, true, err
+	case len(data) >= 2 && ecoffMagics[binary.BigEndian.Uint16(data)]:
+		code, err = ecoffText(data)
+		return code, true, err
+	}
+	return data, false, nil
+}
+
+// PifBootCodeSize is the size of the pif bootstrap region in development
+// board ramrom.
+const PifBootCodeSize = 0x1000
+
+// LoadBootCode reads boot code from a raw binary, ELF or ECOFF file. Object
+// files must have a .text section holding exactly the boot code. Raw files
+// must either be the boot code alone or the first 0x1000 bytes of a rom,
+// starting with the rom header. filename is only used in errors.
+func LoadBootCode(r io.Reader, filename string) ([]byte, error) {
+	code, isObject, err := readCode(r)
+	if err != nil {
+		return nil, err
+	}
+	pos := Position{Filename: filename}
+	if isObject {
+		if len(code) != BootCodeSize {
+			return nil, newSpecError(pos, "Boot code .text section must be exactly %d bytes, found %d", BootCodeSize, len(code))
+		}
+		return code, nil
+	}
+	switch len(code) {
+	case BootCodeSize:
+		return code, nil
+	case BootCodeStart + BootCodeSize:
+		return code[BootCodeStart:], nil
+	}
+	return nil, newSpecError(pos, "Boot code must be exactly %d bytes, or %d bytes starting with a rom header, found %d",
+		BootCodeSize, BootCodeStart+BootCodeSize, len(code))
+}
+
+// LoadPifBootCode reads the pif bootstrap from a raw binary, ELF or ECOFF
+// file. filename is only used in errors.
+func LoadPifBootCode(r io.Reader, filename string) ([]byte, error) {
+	code, _, err := readCode(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(code) == 0 || len(code) > PifBootCodeSize {
+		return nil, newSpecError(Position{Filename: filename}, "Pif bootstrap must be between 1 and %d bytes, found %d", PifBootCodeSize, len(code))
+	}
+	return code, nil
+}
+
+func elfText(data []byte) ([]byte, error) {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	text := f.Section(".text")
+	if text == nil {
+		return nil, errors.New("Could not find section named '.text' in boot code ELF file")
+	}
+	return text.Data()
+}
+
+func ecoffText(data []byte) ([]byte, error) {
+	header, err := ecoff.ParseHeader(bytes.NewReader(data), binary.BigEndian)
+	if err != nil {
+		return nil, err
+	}
+	for _, section := range header.SectionHeaders {
+		if strings.TrimRight(string(section.Name[:]), "\x00") != ".text" {
+			continue
+		}
+		start := int64(section.SectionPointer)
+		end := start + int64(section.Size)
+		if section.Size < 0 || end > int64(len(data)) {
+			return nil, errors.New("Boot code ECOFF .text section extends past the end of the file")
+		}
+		return data[start:end], nil
+	}
+	return nil, errors.New("Could not find section named '.text' in boot code ECOFF file")
+}
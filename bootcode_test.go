@@ -0,0 +1,76 @@
+package spicy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/trhodeos/ecoff"
+	"testing"
+)
+
+func bootCodePattern(size int) []byte {
+	out := make([]byte, size)
+	for i := range out {
+		out[i] = byte(i)
+	}
+	return out
+}
+
+func TestLoadRawBootCode(t *testing.T) {
+	assert := assert.New(t)
+	code := bootCodePattern(BootCodeSize)
+	loaded, err := LoadBootCode(bytes.NewReader(code), "Boot")
+	assert.Nil(err)
+	assert.Equal(code, loaded)
+
+	// The front of an existing rom.
+	front := append(make([]byte, BootCodeStart), code...)
+	loaded, err = LoadBootCode(bytes.NewReader(front), "Boot")
+	assert.Nil(err)
+	assert.Equal(code, loaded)
+
+	// A whole rom, or anything else, isn't cut down to size.
+	for _, size := range []int{1024, BootCodeSize + 1, BootCodeStart + BootCodeSize + 0x100} {
+		_, err = LoadBootCode(bytes.NewReader(append(front, make([]byte, 0x100)...)[:size]), "Boot")
+		var specErr *SpecError
+		if assert.ErrorAs(err, &specErr, "size %d", size) {
+			assert.Equal(Position{Filename: "Boot"}, specErr.Pos)
+			assert.Contains(err.Error(), fmt.Sprintf("Boot: Boot code must be exactly %d bytes", BootCodeSize))
+		}
+	}
+}
+
+func TestLoadPifBootCode(t *testing.T) {
+	code := bootCodePattern(0x800)
+	loaded, err := LoadPifBootCode(bytes.NewReader(code), "pif2Boot")
+	assert.Nil(t, err)
+	assert.Equal(t, code, loaded)
+
+	_, err = LoadPifBootCode(bytes.NewReader(bootCodePattern(PifBootCodeSize+1)), "pif2Boot")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "pif2Boot: Pif bootstrap must be between 1 and 4096 bytes, found 4097")
+	}
+}
+
+func TestLoadEcoffBootCode(t *testing.T) {
+	assert := assert.New(t)
+	code := bootCodePattern(BootCodeSize)
+	header := ecoff.Header{
+		FileHeader:     ecoff.FileHeader{Magic: 0x0160, NumSections: 1},
+		SectionHeaders: []ecoff.SectionHeader{{Size: int32(len(code))}},
+	}
+	copy(header.SectionHeaders[0].Name[:], ".text")
+	headerSize := binary.Size(header.FileHeader) + binary.Size(header.ObjectHeader) + binary.Size(header.SectionHeaders[0])
+	header.SectionHeaders[0].SectionPointer = uint32(headerSize)
+
+	b := &bytes.Buffer{}
+	assert.Nil(binary.Write(b, binary.BigEndian, header.FileHeader))
+	assert.Nil(binary.Write(b, binary.BigEndian, header.ObjectHeader))
+	assert.Nil(binary.Write(b, binary.BigEndian, header.SectionHeaders[0]))
+	b.Write(code)
+
+	loaded, err := LoadBootCode(b, "Boot")
+	assert.Nil(err)
+	assert.Equal(code, loaded)
+}
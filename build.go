@@ -0,0 +1,269 @@
+package spicy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/trhodeos/n64rom"
+)
+
+// Options configures Build.
+type Options struct {
+	// The spec file to build.
+	SpecFile      string
+	IncludeFlags  []string
+	DefineFlags   []string
+	UndefineFlags []string
+
+	Cpp     Runner
+	As      Runner
+	Ld      Runner
+	Objcopy Runner
+
+	// Optional inputs. Nil readers are skipped; a nil RomHeader means a
+	// blank header is used.
+	RomHeader     io.Reader
+	RomHeaderName string
+	BootCode      io.Reader
+	BootCodeName  string
+	Font          io.Reader
+	// The pif bootstrap, which development boards load from ramrom, and
+	// the rom offset to put it at. The offset must be set if it is.
+	PifBootCode       io.Reader
+	PifBootCodeName   string
+	PifBootCodeOffset int64
+
+	// The byte holes in the rom are filled with.
+	Fill byte
+	// Rom size in Mbits to pad to, or 0 to leave the rom unpadded.
+	RomSizeMbits int
+	// The CIC to compute the checksum for, or 0 to detect it from the boot
+	// code. Failing to detect it is only a warning.
+	CIC                  CIC
+	DisableOverlapChecks bool
+	// Keep the build's scratch directory even if the build succeeds. It is
+	// always kept when the build fails.
+	KeepScratch bool
+}
+
+// Result is the output of a successful Build.
+type Result struct {
+	Spec  *Spec
+	Waves []*LinkedWave
+	// The finished rom image.
+	Rom []byte
+	// Unused bytes at the end of the rom, if it was padded to a size.
+	Slack int
+}
+
+// LoadSpec preprocesses and parses opts.SpecFile, the first step of Build.
+// Only the spec file, cpp flags and Cpp runner in opts are used.
+func LoadSpec(ctx context.Context, opts Options) (*Spec, error) {
+	preprocessed, err := preprocessSpecFile(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return parseSpecFile(preprocessed, opts)
+}
+
+func preprocessSpecFile(ctx context.Context, opts Options) ([]byte, error) {
+	f, err := os.Open(opts.SpecFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	preprocessed, err := PreprocessSpec(ctx, f, opts.Cpp, opts.IncludeFlags, opts.DefineFlags, opts.UndefineFlags)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(preprocessed)
+}
+
+func parseSpecFile(preprocessed []byte, opts Options) (*Spec, error) {
+	spec, err := ParseNamedSpec(bytes.NewReader(preprocessed), opts.SpecFile)
+	if err != nil {
+		return nil, &ParseError{Err: err}
+	}
+	return spec, nil
+}
+
+// Build runs the whole makerom pipeline: preprocessing and parsing the spec,
+// linking each wave and assembling the rom image. Errors are returned as
+// *ParseError, *ToolError, *LinkError or *SizeError where they fit.
+func Build(ctx context.Context, opts Options) (result *Result, err error) {
+	// The boot code checksums the megabyte after itself, which doesn't fit
+	// in the smallest roms.
+	if opts.RomSizeMbits > 0 && MbitsToBytes(opts.RomSizeMbits) < ChecksumEnd {
+		return nil, &SizeError{Err: errors.New(fmt.Sprintf("Rom size %d Mbits (0x%x bytes) is smaller than the 0x%x bytes the boot code checksums",
+			opts.RomSizeMbits, MbitsToBytes(opts.RomSizeMbits), ChecksumEnd))}
+	}
+	out := &Result{}
+	// Every build gets its own scratch directory, so concurrent builds
+	// don't collide.
+	dir, err := ioutil.TempDir("", "spicy")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			log.Warnf("Build failed, keeping scratch directory %s", dir)
+			return
+		}
+		if opts.KeepScratch {
+			log.Infof("Keeping scratch directory %s", dir)
+			return
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warnf("Could not remove scratch directory %s: %s", dir, err)
+		}
+	}()
+
+	out.Spec, err = LoadSpec(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	header := n64rom.GetBlankHeader()
+	if opts.RomHeader != nil {
+		header, err = ParseRomHeader(opts.RomHeader, opts.RomHeaderName)
+		if err != nil {
+			return nil, &ParseError{Err: err}
+		}
+	}
+	var bootCode, font []byte
+	if opts.BootCode != nil {
+		bootCode, err = LoadBootCode(opts.BootCode, opts.BootCodeName)
+		if err != nil {
+			return nil, &ParseError{Err: err}
+		}
+	}
+	var pifBootCode []byte
+	if opts.PifBootCode != nil {
+		pifBootCode, err = LoadPifBootCode(opts.PifBootCode, opts.PifBootCodeName)
+		if err != nil {
+			return nil, &ParseError{Err: err}
+		}
+		if opts.PifBootCodeOffset < n64rom.CodeStart {
+			return nil, &SizeError{Err: errors.New(fmt.Sprintf("Pif bootstrap offset 0x%x must be at least 0x%x, past the header and boot code",
+				opts.PifBootCodeOffset, n64rom.CodeStart))}
+		}
+	}
+	var symbols []Symbol
+	if opts.Font != nil {
+		font, err = LoadFont(opts.Font)
+		if err != nil {
+			return nil, &ParseError{Err: err}
+		}
+		symbols = append(symbols, FontSymbols(font)...)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	out.Waves, err = LinkWaves(ctx, dir, out.Spec, opts.As, opts.Ld, symbols)
+	if err != nil {
+		return nil, err
+	}
+	rom, err := n64rom.NewRomFile(header, nil, nil, opts.Fill)
+	if err != nil {
+		return nil, err
+	}
+	for _, linked := range out.Waves {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		w := linked.Wave
+		err = CheckMaxSizes(w, bytes.NewReader(linked.Object))
+		if _, ok := err.(*MaxSizeError); ok {
+			return nil, &SizeError{Err: err}
+		} else if err != nil {
+			return nil, &LinkError{Wave: w.Name, Err: err}
+		}
+		if !opts.DisableOverlapChecks {
+			err = CheckOverlaps(w, bytes.NewReader(linked.Object))
+			if err != nil {
+				return nil, &LinkError{Wave: w.Name, Err: err}
+			}
+		}
+		binarized, err := BinarizeObject(ctx, dir, w, bytes.NewReader(linked.Object), opts.Objcopy)
+		if err != nil {
+			return nil, err
+		}
+		binarizedBytes, err := ioutil.ReadAll(binarized)
+		if err != nil {
+			return nil, err
+		}
+		err = rom.WriteAt(binarizedBytes, int64(linked.RomStart))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The font goes in the tail of the boot code region, so the CIC has to
+	// be detected from the boot code as loaded.
+	cic := opts.CIC
+	var cicErr error
+	if cic == 0 {
+		if bootCode == nil {
+			cicErr = errors.New("No boot code to detect the CIC from; specify the CIC explicitly")
+		} else {
+			cic, cicErr = DetectBootCodeCIC(bootCode)
+		}
+	}
+
+	image := NewImage(opts.Fill)
+	_, err = rom.Save(image)
+	if err != nil {
+		return nil, err
+	}
+	if bootCode != nil {
+		image.WriteAt(bootCode, BootCodeStart)
+	}
+	if font != nil {
+		image.WriteAt(font, FontStart)
+	}
+	if pifBootCode != nil {
+		if err := placePifBootCode(image, out.Waves, pifBootCode, opts.PifBootCodeOffset, opts.Fill); err != nil {
+			return nil, err
+		}
+	}
+	if opts.RomSizeMbits > 0 {
+		out.Slack, err = image.PadToMbits(opts.RomSizeMbits)
+		if err != nil {
+			return nil, &SizeError{Err: err}
+		}
+		log.Infof("Rom has 0x%x bytes (%d%%) unused.", out.Slack, out.Slack*100/len(image.Bytes()))
+	} else {
+		// The boot code checksums the first megabyte after itself, so the rom
+		// must be at least that big.
+		image.Pad(ChecksumEnd)
+	}
+	if cicErr != nil {
+		log.Warnf("Not updating rom checksum: %s", cicErr)
+	} else if err := UpdateChecksum(image.Bytes(), cic); err != nil {
+		return nil, err
+	}
+	out.Rom = image.Bytes()
+	return out, nil
+}
+
+// placePifBootCode writes the pif bootstrap, padded to PifBootCodeSize, at
+// offset, which mustn't overlap any wave.
+func placePifBootCode(image *Image, waves []*LinkedWave, code []byte, offset int64, fill byte) error {
+	end := uint64(offset) + PifBootCodeSize
+	for _, l := range waves {
+		if uint64(offset) < l.RomEnd && l.RomStart < end {
+			return &SizeError{Err: errors.New(fmt.Sprintf("Pif bootstrap at 0x%x-0x%x overlaps wave %s at 0x%x-0x%x",
+				offset, end, l.Wave.Name, l.RomStart, l.RomEnd))}
+		}
+	}
+	padded := append(append([]byte{}, code...), bytes.Repeat([]byte{fill}, PifBootCodeSize-len(code))...)
+	_, err := image.WriteAt(padded, offset)
+	return err
+}
@@ -0,0 +1,154 @@
+package spicy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// catRunner echoes its stdin, standing in for cpp.
+type catRunner struct{}
+
+func (catRunner) Run(r io.Reader, args []string) (io.Reader, error) {
+	return r, nil
+}
+
+func TestBuildReturnsParseErrors(t *testing.T) {
+	assert := assert.New(t)
+	specFile := filepath.Join(t.TempDir(), "bad.spec")
+	assert.Nil(ioutil.WriteFile(specFile, []byte("beginseg\n  bogus 1\nendseg\n"), 0644))
+	_, err := Build(context.Background(), Options{SpecFile: specFile, Cpp: catRunner{}})
+	var parseErr *ParseError
+	assert.True(errors.As(err, &parseErr))
+	var specErr *SpecError
+	if assert.True(errors.As(err, &specErr)) {
+		assert.Equal(Position{Filename: specFile, Line: 2, Column: 3}, specErr.Pos)
+	}
+}
+
+func TestBuildReturnsToolErrors(t *testing.T) {
+	assert := assert.New(t)
+	specFile := filepath.Join(t.TempDir(), "game.spec")
+	assert.Nil(ioutil.WriteFile(specFile, nil, 0644))
+	_, err := Build(context.Background(), Options{SpecFile: specFile, Cpp: NewRunner(filepath.Join(t.TempDir(), "no-such-cpp"))})
+	var toolErr *ToolError
+	assert.True(errors.As(err, &toolErr))
+}
+
+func TestBuildAndDryRunRejectWavesWithoutBootSegment(t *testing.T) {
+	assert := assert.New(t)
+	specFile := filepath.Join(t.TempDir(), "game.spec")
+	spec := "beginseg\n  name \"code\"\n  flags OBJECT\nendseg\nbeginwave\n  name \"w\"\n  include \"code\"\nendwave\n"
+	assert.Nil(ioutil.WriteFile(specFile, []byte(spec), 0644))
+	opts := Options{SpecFile: specFile, Cpp: catRunner{}}
+	_, buildErr := Build(context.Background(), opts)
+	_, dryRunErr := DryRun(context.Background(), opts, t.TempDir())
+	for _, err := range []error{buildErr, dryRunErr} {
+		var parseErr *ParseError
+		assert.True(errors.As(err, &parseErr))
+		var specErr *SpecError
+		if assert.True(errors.As(err, &specErr)) {
+			assert.Equal(Position{Filename: specFile, Line: 5, Column: 1}, specErr.Pos)
+			assert.Equal("Wave w has no boot segment", specErr.Msg)
+		}
+	}
+}
+
+// emptySpec writes a spec with no waves, so Build only assembles the rom
+// header, boot code and font.
+func emptySpec(t *testing.T) string {
+	specFile := filepath.Join(t.TempDir(), "empty.spec")
+	if err := ioutil.WriteFile(specFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return specFile
+}
+
+func TestBuildDetectsCICBeforePlacingFont(t *testing.T) {
+	assert := assert.New(t)
+	code := bootCodePattern(BootCodeSize)
+	// Pretend the pattern is 6105 boot code.
+	sum := crc32.ChecksumIEEE(code)
+	bootCodeCICs[sum] = CIC6105
+	defer delete(bootCodeCICs, sum)
+	font := bytes.Repeat([]byte{0xaa}, 0x100)
+
+	result, err := Build(context.Background(), Options{
+		SpecFile: emptySpec(t),
+		Cpp:      catRunner{},
+		BootCode: bytes.NewReader(code),
+		Font:     bytes.NewReader(font),
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	rom := result.Rom
+	assert.Equal(code[:FontStart-BootCodeStart], rom[BootCodeStart:FontStart])
+	assert.Equal(font, rom[FontStart:FontStart+len(font)])
+	crc1, crc2, err := CalculateChecksum(rom, CIC6105)
+	assert.NoError(err)
+	assert.Equal(crc1, binary.BigEndian.Uint32(rom[crc1Offset:]))
+	assert.Equal(crc2, binary.BigEndian.Uint32(rom[crc2Offset:]))
+}
+
+func TestBuildRejectsRomsTooSmallToChecksum(t *testing.T) {
+	assert := assert.New(t)
+	_, err := Build(context.Background(), Options{SpecFile: emptySpec(t), Cpp: catRunner{}, RomSizeMbits: 8})
+	var sizeErr *SizeError
+	if assert.True(errors.As(err, &sizeErr)) {
+		assert.Contains(err.Error(), "Rom size 8 Mbits (0x100000 bytes) is smaller than the 0x101000 bytes")
+	}
+
+	result, err := Build(context.Background(), Options{SpecFile: emptySpec(t), Cpp: catRunner{}, RomSizeMbits: 16, Fill: 0xff})
+	if assert.NoError(err) {
+		assert.Len(result.Rom, 0x200000)
+		assert.Equal(byte(0xff), result.Rom[len(result.Rom)-1])
+	}
+}
+
+func TestBuildPlacesPifBootCode(t *testing.T) {
+	assert := assert.New(t)
+	code := bootCodePattern(0x800)
+	result, err := Build(context.Background(), Options{
+		SpecFile:          emptySpec(t),
+		Cpp:               catRunner{},
+		PifBootCode:       bytes.NewReader(code),
+		PifBootCodeName:   "pif2Boot",
+		PifBootCodeOffset: 0x2000,
+		Fill:              0xff,
+	})
+	if assert.NoError(err) {
+		rom := result.Rom
+		assert.Equal(code, rom[0x2000:0x2800])
+		assert.Equal(bytes.Repeat([]byte{0xff}, 0x800), rom[0x2800:0x3000])
+	}
+
+	_, err = Build(context.Background(), Options{
+		SpecFile:          emptySpec(t),
+		Cpp:               catRunner{},
+		PifBootCode:       bytes.NewReader(code),
+		PifBootCodeOffset: 0x800,
+	})
+	var sizeErr *SizeError
+	if assert.True(errors.As(err, &sizeErr)) {
+		assert.Contains(err.Error(), "Pif bootstrap offset 0x800 must be at least 0x1000")
+	}
+}
+
+func TestPlacePifBootCodeRejectsOverlappingWaves(t *testing.T) {
+	image := &Image{}
+	waves := []*LinkedWave{{Wave: &Wave{Name: "main"}, RomStart: 0x1000, RomEnd: 0x2800}}
+	err := placePifBootCode(image, waves, []byte{1}, 0x2000, 0)
+	var sizeErr *SizeError
+	if assert.True(t, errors.As(err, &sizeErr)) {
+		assert.Contains(t, err.Error(), "Pif bootstrap at 0x2000-0x3000 overlaps wave main at 0x1000-0x2800")
+	}
+	assert.NoError(t, placePifBootCode(image, waves, []byte{1}, 0x2800, 0))
+}
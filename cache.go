@@ -0,0 +1,272 @@
+package spicy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Cache stores the output files of tool runs in a directory, keyed by a hash
+// of the tool and everything the run reads, so unchanged steps of a build
+// don't need to run again.
+type Cache struct {
+	dir    string
+	hits   int64
+	misses int64
+}
+
+// NewCache returns a cache storing its entries in dir, creating it if needed.
+func NewCache(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Cache{dir: dir}, nil
+}
+
+// Stats returns the number of cache hits and misses so far.
+func (c *Cache) Stats() (hits int64, misses int64) {
+	return atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)
+}
+
+// Wrap returns a runner that caches the runs r makes for a MappedFileRunner.
+// Other runs, such as cpp's, can read files the cache can't know about, so
+// they always run. tool names the command r runs; it and its --version
+// output are part of the cache key.
+func (c *Cache) Wrap(r Runner, tool string) *CachingRunner {
+	return &CachingRunner{runner: r, cache: c, tool: tool}
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+func (c *Cache) get(key string) ([]byte, bool) {
+	b, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddInt64(&c.hits, 1)
+	return b, true
+}
+
+func (c *Cache) put(key string, b []byte) error {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Concurrent builds may write the same entry, so write it whole and
+	// rename it into place.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// CachingRunner is a Runner whose MappedFileRunner runs are cached.
+type CachingRunner struct {
+	runner Runner
+	cache  *Cache
+	tool   string
+
+	versionOnce sync.Once
+	version     string
+}
+
+// Command returns the command the runner caches.
+func (c *CachingRunner) Command() string {
+	return c.tool
+}
+
+func (c *CachingRunner) Run(r io.Reader, args []string) (io.Reader, error) {
+	return RunContext(context.Background(), c.runner, r, args)
+}
+
+func (c *CachingRunner) RunContext(ctx context.Context, r io.Reader, args []string) (io.Reader, error) {
+	return RunContext(ctx, c.runner, r, args)
+}
+
+// How long toolVersion waits for --version before falling back to the binary.
+const toolVersionTimeout = 10 * time.Second
+
+// toolVersion identifies the tool by its resolved path and --version output.
+func (c *CachingRunner) toolVersion(ctx context.Context) string {
+	c.versionOnce.Do(func() {
+		path, err := exec.LookPath(c.tool)
+		if err != nil {
+			path = c.tool
+		}
+		ctx, cancel := context.WithTimeout(ctx, toolVersionTimeout)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, path, "--version").Output()
+		if err != nil {
+			// Fall back to the binary itself changing.
+			if info, statErr := os.Stat(path); statErr == nil {
+				out = []byte(fmt.Sprintf("%d %d", info.Size(), info.ModTime().UnixNano()))
+			}
+		}
+		c.version = path + "\n" + string(out)
+	})
+	return c.version
+}
+
+// writeField adds a length-prefixed field to the hash, so fields can't run
+// into each other.
+func writeField(h hash.Hash, b []byte) {
+	fmt.Fprintf(h, "%d:", len(b))
+	h.Write(b)
+}
+
+// mappedRun is everything a MappedFileRunner run reads, held in memory so it
+// can be hashed and then still be run.
+type mappedRun struct {
+	m      MappedFileRunner
+	args   []string
+	stdin  []byte
+	inputs map[string][]byte
+}
+
+func readMappedRun(m MappedFileRunner, r io.Reader, args []string) (*mappedRun, error) {
+	run := &mappedRun{m: m, args: args, inputs: map[string][]byte{}}
+	if r != nil {
+		var err error
+		if run.stdin, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+	for name, input := range m.inputFileArgs {
+		b, err := ioutil.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		run.inputs[name] = b
+	}
+	return run, nil
+}
+
+// generic replaces the run's scratch directory and output path in s, which
+// change from build to build without changing what the tool does.
+func (run *mappedRun) generic(s string) string {
+	if run.m.outputFileArg != "" {
+		s = strings.ReplaceAll(s, run.m.outputFileArg, "<output>")
+	}
+	if run.m.dir != "" {
+		s = strings.ReplaceAll(s, run.m.dir, "<dir>")
+	}
+	return s
+}
+
+// genericArgs returns the run's arguments, before input files are mapped,
+// made generic.
+func (run *mappedRun) genericArgs() []string {
+	var out []string
+	for _, arg := range run.args {
+		out = append(out, run.generic(arg))
+	}
+	return out
+}
+
+// key hashes tool, which identifies the tool that runs, with the arguments,
+// stdin, the contents of the input files and the dependencies.
+func (run *mappedRun) key(tool string) string {
+	h := sha256.New()
+	writeField(h, []byte(tool))
+	for _, arg := range run.genericArgs() {
+		writeField(h, []byte(arg))
+	}
+	writeField(h, run.stdin)
+	var names []string
+	for name := range run.inputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeField(h, []byte(name))
+		writeField(h, []byte(run.generic(string(run.inputs[name]))))
+	}
+	for _, dep := range run.m.dependencies {
+		writeField(h, []byte(run.generic(dep)))
+		b, err := ioutil.ReadFile(dep)
+		if err != nil {
+			// The tool will report it.
+			b = []byte(err.Error())
+		}
+		writeField(h, b)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// run runs the MappedFileRunner with runner and returns its output file.
+func (run *mappedRun) run(ctx context.Context, runner Runner) ([]byte, error) {
+	m := run.m
+	m.runner = runner
+	m.inputFileArgs = map[string]io.Reader{}
+	for name, b := range run.inputs {
+		m.inputFileArgs[name] = bytes.NewReader(b)
+	}
+	var stdin io.Reader
+	if run.stdin != nil {
+		stdin = bytes.NewReader(run.stdin)
+	}
+	result, err := m.RunContext(ctx, stdin, run.args)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(result)
+}
+
+// replay writes out, a recorded output of the run, to its output file.
+func (run *mappedRun) replay(out []byte) (io.Reader, error) {
+	if err := ioutil.WriteFile(run.m.outputFileArg, out, 0644); err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(out), nil
+}
+
+// runMapped runs m through the cache.
+func (c *CachingRunner) runMapped(ctx context.Context, m MappedFileRunner, r io.Reader, args []string) (io.Reader, error) {
+	run, err := readMappedRun(m, r, args)
+	if err != nil {
+		return nil, err
+	}
+	key := run.key(c.toolVersion(ctx))
+	if out, ok := c.cache.get(key); ok {
+		log.Debugf("Cache hit for %s %s", c.tool, strings.Join(args, " "))
+		return run.replay(out)
+	}
+	log.Debugf("Cache miss for %s %s", c.tool, strings.Join(args, " "))
+	out, err := run.run(ctx, c.runner)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.cache.put(key, out); err != nil {
+		log.Warnf("Could not write to the cache: %s", err)
+	}
+	return bytes.NewReader(out), nil
+}
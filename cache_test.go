@@ -0,0 +1,101 @@
+package spicy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// copyRunner copies its first argument to its last, like a tool turning an
+// input file into an output file, and counts how often it ran.
+type copyRunner struct {
+	runs int
+}
+
+func (c *copyRunner) Run(r io.Reader, args []string) (io.Reader, error) {
+	c.runs++
+	b, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return &bytes.Buffer{}, ioutil.WriteFile(args[len(args)-1], b, 0644)
+}
+
+func TestCacheReplaysOutputs(t *testing.T) {
+	cache, err := NewCache(t.TempDir())
+	assert.NoError(t, err)
+	inner := &copyRunner{}
+	runner := cache.Wrap(inner, "spicy-test-tool")
+
+	run := func(input string) string {
+		// Every build has its own scratch directory.
+		dir := t.TempDir()
+		output := filepath.Join(dir, "out.bin")
+		m := NewMappedFileRunner(runner, map[string]io.Reader{"in": strings.NewReader(input)}, output).InDir(dir)
+		out, err := m.Run(nil, []string{"in", output})
+		assert.NoError(t, err)
+		b, err := ioutil.ReadAll(out)
+		assert.NoError(t, err)
+		onDisk, err := ioutil.ReadFile(output)
+		assert.NoError(t, err)
+		assert.Equal(t, b, onDisk)
+		return string(b)
+	}
+
+	assert.Equal(t, "hello", run("hello"))
+	assert.Equal(t, "hello", run("hello"))
+	assert.Equal(t, 1, inner.runs)
+	assert.Equal(t, "world", run("world"))
+	assert.Equal(t, 2, inner.runs)
+
+	hits, misses := cache.Stats()
+	assert.Equal(t, int64(1), hits)
+	assert.Equal(t, int64(2), misses)
+}
+
+func TestCacheKeysOnDependencies(t *testing.T) {
+	cache, err := NewCache(t.TempDir())
+	assert.NoError(t, err)
+	inner := &copyRunner{}
+	runner := cache.Wrap(inner, "spicy-test-tool")
+	dir := t.TempDir()
+	dep := filepath.Join(dir, "dep.o")
+	output := filepath.Join(dir, "out.bin")
+
+	run := func() {
+		m := NewMappedFileRunner(runner, map[string]io.Reader{"in": strings.NewReader("x")}, output).InDir(dir).WithDependencies(dep)
+		_, err := m.Run(nil, []string{"in", output})
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, ioutil.WriteFile(dep, []byte("one"), 0644))
+	run()
+	run()
+	assert.Equal(t, 1, inner.runs)
+	assert.NoError(t, ioutil.WriteFile(dep, []byte("two"), 0644))
+	run()
+	assert.Equal(t, 2, inner.runs)
+}
+
+func TestCachePassesOtherRunsThrough(t *testing.T) {
+	cache, err := NewCache(t.TempDir())
+	assert.NoError(t, err)
+	inner := &copyRunner{}
+	runner := cache.Wrap(inner, "spicy-test-tool")
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in")
+	assert.NoError(t, ioutil.WriteFile(input, []byte("x"), 0644))
+
+	for i := 0; i < 2; i++ {
+		_, err := runner.Run(nil, []string{input, filepath.Join(dir, "out")})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, inner.runs)
+	hits, misses := cache.Stats()
+	assert.Equal(t, int64(0), hits+misses)
+}
@@ -0,0 +1,150 @@
+package spicy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/bits"
+)
+
+// CIC identifies the lockout chip a cartridge's boot code was written for.
+type CIC int
+
+const (
+	CIC6101 CIC = 6101
+	CIC6102 CIC = 6102
+	CIC6103 CIC = 6103
+	CIC6105 CIC = 6105
+	CIC6106 CIC = 6106
+	CIC7101 CIC = 7101
+	CIC7102 CIC = 7102
+	CIC7103 CIC = 7103
+	CIC7105 CIC = 7105
+	CIC7106 CIC = 7106
+)
+
+const (
+	headerSize   = 0x40
+	bootCodeSize = 0x1000 - headerSize
+	crc1Offset   = 0x10
+	crc2Offset   = 0x14
+
+	checksumStart = 0x1000
+	// The boot code only checks the first megabyte after itself.
+	checksumLength = 0x100000
+	ChecksumEnd    = checksumStart + checksumLength
+)
+
+// CRC32s of the known boot codes. The PAL 7101, 7103, 7105 and 7106 boot codes
+// are identical to their NTSC counterparts, so they are detected as those.
+var bootCodeCICs = map[uint32]CIC{
+	0x6170A4A1: CIC6101,
+	0x009E9EA3: CIC7102,
+	0x90BB6CB5: CIC6102,
+	0x0B050EE0: CIC6103,
+	0x98BC2C86: CIC6105,
+	0xACC8580A: CIC6106,
+}
+
+// checksumVariant maps each CIC to the NTSC chip whose checksum it uses.
+var checksumVariant = map[CIC]CIC{
+	CIC6101: CIC6102,
+	CIC6102: CIC6102,
+	CIC6103: CIC6103,
+	CIC6105: CIC6105,
+	CIC6106: CIC6106,
+	CIC7101: CIC6102,
+	CIC7102: CIC6102,
+	CIC7103: CIC6103,
+	CIC7105: CIC6105,
+	CIC7106: CIC6106,
+}
+
+var checksumSeeds = map[CIC]uint32{
+	CIC6102: 0xF8CA4DDC,
+	CIC6103: 0xA3886759,
+	CIC6105: 0xDF26F436,
+	CIC6106: 0x1FEA617A,
+}
+
+// DetectCIC identifies the CIC from the boot code in rom.
+func DetectCIC(rom []byte) (CIC, error) {
+	if len(rom) < headerSize+bootCodeSize {
+		return 0, errors.New("Rom is too small to contain boot code")
+	}
+	return DetectBootCodeCIC(rom[headerSize : headerSize+bootCodeSize])
+}
+
+// DetectBootCodeCIC identifies the CIC from the boot code alone.
+func DetectBootCodeCIC(code []byte) (CIC, error) {
+	if len(code) != bootCodeSize {
+		return 0, errors.New(fmt.Sprintf("Boot code must be exactly %d bytes, found %d", bootCodeSize, len(code)))
+	}
+	sum := crc32.ChecksumIEEE(code)
+	cic, ok := bootCodeCICs[sum]
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("Unknown boot code (crc32 0x%08X); specify the CIC explicitly", sum))
+	}
+	return cic, nil
+}
+
+// CalculateChecksum computes the two header CRC words the boot code for cic
+// verifies at startup.
+func CalculateChecksum(rom []byte, cic CIC) (uint32, uint32, error) {
+	variant, ok := checksumVariant[cic]
+	if !ok {
+		return 0, 0, errors.New(fmt.Sprintf("Unsupported CIC %d", cic))
+	}
+	if len(rom) < ChecksumEnd {
+		return 0, 0, errors.New(fmt.Sprintf("Rom must be at least 0x%x bytes to checksum, found 0x%x", ChecksumEnd, len(rom)))
+	}
+	seed := checksumSeeds[variant]
+	t1, t2, t3, t4, t5, t6 := seed, seed, seed, seed, seed, seed
+	for i := checksumStart; i < ChecksumEnd; i += 4 {
+		d := binary.BigEndian.Uint32(rom[i:])
+		if t6+d < t6 {
+			t4++
+		}
+		t6 += d
+		t3 ^= d
+		r := bits.RotateLeft32(d, int(d&0x1F))
+		t5 += r
+		if t2 > d {
+			t2 ^= r
+		} else {
+			t2 ^= t6 ^ d
+		}
+		if variant == CIC6105 {
+			t1 += binary.BigEndian.Uint32(rom[headerSize+0x0710+(i&0xFF):]) ^ d
+		} else {
+			t1 += t5 ^ d
+		}
+	}
+	switch variant {
+	case CIC6103:
+		return (t6 ^ t4) + t3, (t5 ^ t2) + t1, nil
+	case CIC6106:
+		return (t6 * t4) + t3, (t5 * t2) + t1, nil
+	}
+	return t6 ^ t4 ^ t3, t5 ^ t2 ^ t1, nil
+}
+
+// UpdateChecksum writes the header CRC words for cic into rom. A cic of 0
+// means detect it from the boot code.
+func UpdateChecksum(rom []byte, cic CIC) error {
+	var err error
+	if cic == 0 {
+		cic, err = DetectCIC(rom)
+		if err != nil {
+			return err
+		}
+	}
+	crc1, crc2, err := CalculateChecksum(rom, cic)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(rom[crc1Offset:], crc1)
+	binary.BigEndian.PutUint32(rom[crc2Offset:], crc2)
+	return nil
+}
@@ -1,21 +1,92 @@
 package main
 
 import (
-	"debug/elf"
+	"encoding/json"
 	"fmt"
+	flag "github.com/ogier/pflag"
+	"github.com/trhodeos/spicy"
+	"io"
 	"os"
+	"strings"
+	"text/tabwriter"
 )
 
-func main() {
-	path := os.Args[1]
-	f, err := elf.Open(path)
+var (
+	jsonOutput   = flag.BoolP("json", "j", false, "Print the report as JSON.")
+	segmentsOnly = flag.BoolP("segments", "s", false, "Only print the spicy segments.")
+)
+
+func printTables(w io.Writer, r *spicy.ElfReport) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if !*segmentsOnly {
+		fmt.Fprintln(tw, "Sections:")
+		fmt.Fprintln(tw, "  Name\tType\tAddr\tOffset\tSize\tFlags\t")
+		for _, s := range r.Sections {
+			fmt.Fprintf(tw, "  %s\t%s\t0x%08x\t0x%06x\t0x%06x\t%s\t\n", s.Name, s.Type, s.Addr, s.Offset, s.Size, s.Flags)
+		}
+		fmt.Fprintln(tw, "\nProgram headers:")
+		fmt.Fprintln(tw, "  Type\tOffset\tVaddr\tPaddr\tFilesz\tMemsz\tFlags\t")
+		for _, p := range r.Programs {
+			fmt.Fprintf(tw, "  %s\t0x%06x\t0x%08x\t0x%08x\t0x%06x\t0x%06x\t%s\t\n", p.Type, p.Offset, p.Vaddr, p.Paddr, p.Filesz, p.Memsz, p.Flags)
+		}
+		fmt.Fprintln(tw, "\nSymbols:")
+		fmt.Fprintln(tw, "  Value\tSize\tType\tBind\tSection\tName\t")
+		for _, s := range r.Symbols {
+			fmt.Fprintf(tw, "  0x%08x\t%d\t%s\t%s\t%s\t%s\t\n", s.Value, s.Size, s.Type, s.Bind, s.Section, s.Name)
+		}
+		fmt.Fprintln(tw)
+	}
+	fmt.Fprintln(tw, "Segments:")
+	fmt.Fprintln(tw, "  Name\tRom start\tRom end\tText\tData\tBss\tSections\t")
+	for _, s := range r.Segments {
+		b := s.Bounds
+		fmt.Fprintf(tw, "  %s\t0x%08x\t0x%08x\t0x%08x-0x%08x\t0x%08x-0x%08x\t0x%08x-0x%08x\t%s\t\n",
+			s.Name, b.RomStart, b.RomEnd, b.TextStart, b.TextEnd, b.DataStart, b.DataEnd, b.BssStart, b.BssEnd,
+			strings.Join(s.Sections, " "))
+	}
+	for _, s := range r.Segments {
+		if len(s.Symbols) > 0 {
+			fmt.Fprintf(tw, "\nSymbols in segment %s:\n  %s\n", s.Name, strings.Join(s.Symbols, "\n  "))
+		}
+	}
+	return tw.Flush()
+}
+
+func run() int {
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <elf file>\n", os.Args[0])
+		flag.PrintDefaults()
+		return 2
+	}
+	f, err := os.Open(flag.Arg(0))
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
 	defer f.Close()
-
-	fmt.Printf("%+v\n", f)
-	for _, sec := range f.Sections {
-		fmt.Printf("%+v\n", sec.SectionHeader)
+	report, err := spicy.ReadElfReport(f)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *jsonOutput {
+		if *segmentsOnly {
+			report = &spicy.ElfReport{Segments: report.Segments}
+		}
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		err = e.Encode(report)
+	} else {
+		err = printTables(os.Stdout, report)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
+	return 0
+}
+
+func main() {
+	flag.Parse()
+	os.Exit(run())
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	flag "github.com/ogier/pflag"
+	"github.com/trhodeos/spicy"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+const (
+	fmt_list_text  = "List files whose formatting differs from spicy fmt's."
+	fmt_diff_text  = "Display diffs instead of rewriting files."
+	fmt_write_text = "Write the result to the source file instead of stdout."
+)
+
+// runFmt implements 'spicy fmt [options] <spec file>...'. With -l or -d it
+// exits with exitError if any file isn't formatted, for pre-commit hooks.
+func runFmt(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	list := flags.BoolP("list", "l", false, fmt_list_text)
+	diff := flags.BoolP("diff", "d", false, fmt_diff_text)
+	write := flags.BoolP("write", "w", false, fmt_write_text)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s fmt [options] <spec file>...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	code := exitOK
+	for _, filename := range flags.Args() {
+		src, err := ioutil.ReadFile(filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		formatted, err := spicy.FormatSpec(src, filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitParseError
+		}
+		changed := !bytes.Equal(src, formatted)
+		if changed && (*list || *diff) {
+			code = exitError
+		}
+		if *list && changed {
+			fmt.Println(filename)
+		}
+		if *diff && changed {
+			out, err := diffFiles(filename, src, formatted)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return exitError
+			}
+			os.Stdout.Write(out)
+		}
+		if *write && changed {
+			if err := ioutil.WriteFile(filename, formatted, 0644); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return exitError
+			}
+		}
+		if !*list && !*diff && !*write {
+			os.Stdout.Write(formatted)
+		}
+	}
+	return code
+}
+
+// diffFiles returns a unified diff of the formatting change, using diff(1).
+func diffFiles(filename string, src []byte, formatted []byte) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "spicy-fmt")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	orig, fixed := dir+"/orig", dir+"/fixed"
+	if err := ioutil.WriteFile(orig, src, 0644); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(fixed, formatted, 0644); err != nil {
+		return nil, err
+	}
+	out, err := exec.Command("diff", "-u", "--label", filename+".orig", "--label", filename, orig, fixed).Output()
+	// diff exits with status 1 when the files differ.
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		err = nil
+	}
+	return out, err
+}
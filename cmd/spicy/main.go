@@ -1,12 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	flag "github.com/ogier/pflag"
 	log "github.com/sirupsen/logrus"
-	"github.com/trhodeos/n64rom"
 	"github.com/trhodeos/spicy"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 )
 
 const (
@@ -14,19 +22,30 @@ const (
 	includes_text                          = "Includes passed to cpp."
 	undefine_text                          = "Undefines passed to cpp.."
 	verbose_text                           = "If true, be verbose."
-	verbose_link_editor_text               = "If true, be verbose when link editing."
+	verbose_link_editor_text               = "If true, print a link map of every segment and its symbols."
+	map_file_text                          = "File to write the link map to instead of stdout. Implies -m."
+	map_format_text                        = "Link map format: text or json."
+	segments_header_text                   = "Write a C header declaring the segment symbols to this file and exit without building the rom."
 	disable_overlapping_section_check_text = "If true, disable overlapping section checks."
-	romsize_text                           = "Rom size (MBits)"
+	romsize_text                           = "Rom size in Mbits, which must be a power of two of at least 16"
 	filldata_text                          = "filldata byte"
-	bootstrap_filename_text                = "Bootstrap file (not currently used)"
-	header_filename_text                   = "Header file (not currently used)"
-	pif_bootstrap_filename_text            = "Pif bootstrap file (not currently used)"
+	bootstrap_filename_text                = "Boot code file (raw binary, ELF or ECOFF) to load at 0x40"
+	header_filename_text                   = "ASCII rom header file"
+	pif_bootstrap_filename_text            = "Pif bootstrap file (raw binary, ELF or ECOFF, at most 4K) to load into the image at --pif2boot_offset"
+	pif_bootstrap_offset_text              = "Rom offset to load the --pif2boot_file at, padded to 4K. It must not overlap the boot code or any wave."
 	rom_image_file_text                    = "Rom image filename"
+	elf_file_text                          = "Filename to keep the linked ELF of the first wave under, for debuggers and size-diff. Later waves are written next to it, named after the wave."
 	spec_file_text                         = "Spec file to use for making the image"
 	ld_command_text                        = "ld command to use"
 	as_command_text                        = "as command to use"
 	cpp_command_text                       = "cpp command to use"
 	objcopy_command_text                   = "objcopy command to use"
+	tool_timeout_text                      = "Kill %s if it runs longer than this (e.g. 30s). 0 means no limit."
+	font_filename_text                     = "Font file to load at 0xB70"
+	dry_run_text                           = "Print the commands spicy would run, with the entry source and linker script of every wave, instead of building the rom. Only cpp is run."
+	dry_run_dir_text                       = "Directory --dry_run writes the commands, entry sources and linker scripts to."
+	cache_dir_text                         = "Directory to cache the outputs of as, ld and objcopy in, so unchanged steps aren't rerun. Caching is off if unset."
+	cic_text                               = "CIC to compute the rom checksum for (e.g. 6102). Detected from the boot code if unset."
 )
 
 type arrayFlags []string
@@ -40,29 +59,81 @@ func (i *arrayFlags) Set(value string) error {
 	return nil
 }
 
-var defineFlags arrayFlags
-var includeFlags arrayFlags
-var undefineFlags arrayFlags
-
-var (
-	verbose                           = flag.BoolP("verbose", "d", false, verbose_text)
-	link_editor_verbose               = flag.BoolP("verbose_linking", "m", false, verbose_link_editor_text)
-	disable_overlapping_section_check = flag.BoolP("disable_overlapping_section_checks", "o", false, disable_overlapping_section_check_text)
-	romsize_mbits                     = flag.IntP("romsize", "s", -1, romsize_text)
-	filldata                          = flag.IntP("filldata_byte", "f", 0x0, filldata_text)
-	bootstrap_filename                = flag.StringP("bootstrap_file", "b", "Boot", bootstrap_filename_text)
-	header_filename                   = flag.StringP("romheader_file", "h", "romheader", header_filename_text)
-	pif_bootstrap_filename            = flag.StringP("pif2boot_file", "p", "pif2Boot", pif_bootstrap_filename_text)
-	rom_image_file                    = flag.StringP("rom_name", "r", "rom.n64", rom_image_file_text)
-	elf_file                          = flag.StringP("rom_elf_name", "e", "rom.out", rom_image_file_text)
+// buildFlags are the flags of the main spicy command.
+type buildFlags struct {
+	*flag.FlagSet
+	defines   arrayFlags
+	includes  arrayFlags
+	undefines arrayFlags
+
+	verbose                           *bool
+	link_editor_verbose               *bool
+	disable_overlapping_section_check *bool
+	romsize_mbits                     *int
+	filldata                          *int
+	bootstrap_filename                *string
+	header_filename                   *string
+	pif_bootstrap_filename            *string
+	pif_bootstrap_offset              *int64
+	rom_image_file                    *string
+	elf_file                          *string
+	map_file                          *string
+	map_format                        *string
+	segments_header                   *string
 
 	// Non-standard options. Should all be optional.
-	ld_command      = flag.String("ld_command", "mips64-elf-ld", ld_command_text)
-	as_command      = flag.String("as_command", "mips64-elf-as", as_command_text)
-	cpp_command     = flag.String("cpp_command", "mips64-elf-gcc", cpp_command_text)
-	objcopy_command = flag.String("objcopy_command", "mips64-elf-objcopy", objcopy_command_text)
-	font_filename   = flag.String("font_filename", "font", "Font filename")
-)
+	ld_command      *string
+	as_command      *string
+	cpp_command     *string
+	objcopy_command *string
+	font_filename   *string
+	cic             *int
+	cpp_timeout     *time.Duration
+	as_timeout      *time.Duration
+	ld_timeout      *time.Duration
+	objcopy_timeout *time.Duration
+	cache_dir       *string
+	dry_run         *bool
+	dry_run_dir     *string
+}
+
+func newBuildFlags() *buildFlags {
+	fs := flag.NewFlagSet("spicy", flag.ContinueOnError)
+	f := &buildFlags{FlagSet: fs}
+	fs.VarP(&f.defines, "define", "D", defines_text)
+	fs.VarP(&f.includes, "include", "I", includes_text)
+	fs.VarP(&f.undefines, "undefine", "U", undefine_text)
+	f.verbose = fs.BoolP("verbose", "d", false, verbose_text)
+	f.link_editor_verbose = fs.BoolP("verbose_linking", "m", false, verbose_link_editor_text)
+	f.disable_overlapping_section_check = fs.BoolP("disable_overlapping_section_checks", "o", false, disable_overlapping_section_check_text)
+	f.romsize_mbits = fs.IntP("romsize", "s", -1, romsize_text)
+	f.filldata = fs.IntP("filldata_byte", "f", 0x0, filldata_text)
+	f.bootstrap_filename = fs.StringP("bootstrap_file", "b", "Boot", bootstrap_filename_text)
+	f.header_filename = fs.StringP("romheader_file", "h", "romheader", header_filename_text)
+	f.pif_bootstrap_filename = fs.StringP("pif2boot_file", "p", "", pif_bootstrap_filename_text)
+	f.pif_bootstrap_offset = fs.Int64("pif2boot_offset", 0, pif_bootstrap_offset_text)
+	f.rom_image_file = fs.StringP("rom_name", "r", "rom.n64", rom_image_file_text)
+	f.elf_file = fs.StringP("rom_elf_name", "e", "rom.out", elf_file_text)
+	f.map_file = fs.String("map_file", "", map_file_text)
+	f.map_format = fs.String("map_format", "text", map_format_text)
+	f.segments_header = fs.String("segments_header", "", segments_header_text)
+
+	// Non-standard options. Should all be optional.
+	f.ld_command = fs.String("ld_command", "mips64-elf-ld", ld_command_text)
+	f.as_command = fs.String("as_command", "mips64-elf-as", as_command_text)
+	f.cpp_command = fs.String("cpp_command", "mips64-elf-gcc", cpp_command_text)
+	f.objcopy_command = fs.String("objcopy_command", "mips64-elf-objcopy", objcopy_command_text)
+	f.font_filename = fs.String("font_filename", "font", font_filename_text)
+	f.cic = fs.Int("cic", 0, cic_text)
+	f.cpp_timeout = fs.Duration("cpp_timeout", 0, fmt.Sprintf(tool_timeout_text, "cpp"))
+	f.as_timeout = fs.Duration("as_timeout", 0, fmt.Sprintf(tool_timeout_text, "as"))
+	f.ld_timeout = fs.Duration("ld_timeout", 0, fmt.Sprintf(tool_timeout_text, "ld"))
+	f.objcopy_timeout = fs.Duration("objcopy_timeout", 0, fmt.Sprintf(tool_timeout_text, "objcopy"))
+	f.cache_dir = fs.String("cache_dir", "", cache_dir_text)
+	f.dry_run = fs.Bool("dry_run", false, dry_run_text)
+	f.dry_run_dir = fs.String("dry_run_dir", "spicy_dry_run", dry_run_dir_text)
+	return f
+}
 
 /*
 -Dname[=def] Is passed to cpp(1) for use during its invocation.
@@ -80,91 +151,269 @@ Uname Is passed to cpp(1) for use during its invocation.
 -B 0 An option that concerns only games supported by 64DD. Using this option creates a startup game. For information on startup games, please see Section 15.1, "Restarting," in the N64 Disk Drive Programming Manual.
 */
 
-func main() {
-	flag.VarP(&defineFlags, "define", "D", defines_text)
-	flag.VarP(&includeFlags, "include", "I", includes_text)
-	flag.VarP(&undefineFlags, "undefine", "U", undefine_text)
-	flag.Parse()
-	if *verbose {
+// runnerFactory returns the runner for one of the tools, such as "ld", which
+// runs command.
+type runnerFactory func(tool string, command string, timeout time.Duration) spicy.Runner
+
+// execRunner runs the tools, killing them after timeout.
+func execRunner(tool string, command string, timeout time.Duration) spicy.Runner {
+	return spicy.NewRunner(command).WithTimeout(timeout)
+}
+
+// isSet reports whether the named flag was given on the command line.
+func (f *buildFlags) isSet(name string) bool {
+	set := false
+	f.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// openOptionalFile opens the file named by a flag. A missing file is only an
+// error if the flag was given explicitly; otherwise nil is returned.
+func (f *buildFlags) openOptionalFile(path string, flagName string) (*os.File, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) && !f.isSet(flagName) {
+		log.Infof("No file found at %s for --%s, skipping.", path, flagName)
+		return nil, nil
+	}
+	return file, err
+}
+
+// Exit codes, so build systems can tell failures apart.
+const (
+	exitOK = iota
+	exitError
+	exitUsage
+	exitParseError
+	exitToolError
+	exitLinkError
+	exitSizeError
+)
+
+// exitCode returns the exit code for err. A tool failing while a wave is
+// linked is a tool error rather than a link error, so *ToolError is checked
+// before the *LinkError that wraps it.
+func exitCode(err error) int {
+	var parseErr *spicy.ParseError
+	var sizeErr *spicy.SizeError
+	var linkErr *spicy.LinkError
+	var toolErr *spicy.ToolError
+	switch {
+	case errors.As(err, &parseErr):
+		return exitParseError
+	case errors.As(err, &sizeErr):
+		return exitSizeError
+	case errors.As(err, &toolErr):
+		return exitToolError
+	case errors.As(err, &linkErr):
+		return exitLinkError
+	}
+	return exitError
+}
+
+// run runs spicy with the command line args, not including the program
+// name, using newRunner to run the tools.
+func run(ctx context.Context, args []string, newRunner runnerFactory) int {
+	f := newBuildFlags()
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <spec file>\n", os.Args[0])
+		f.PrintDefaults()
+	}
+	if err := f.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *f.verbose {
 		log.SetLevel(log.DebugLevel)
 	} else {
 		log.SetLevel(log.WarnLevel)
 	}
-	f, err := os.Open(flag.Arg(0))
-	if err != nil {
-		panic(err)
+	if f.NArg() != 1 {
+		f.Usage()
+		return exitUsage
 	}
-	defer f.Close()
 
-	gcc := spicy.NewRunner(*cpp_command)
-	ld := spicy.NewRunner(*ld_command)
-	as := spicy.NewRunner(*as_command)
-	objcopy := spicy.NewRunner(*objcopy_command)
-	preprocessed, err := spicy.PreprocessSpec(f, gcc, includeFlags, defineFlags, undefineFlags)
-	
-	if err != nil {
-		panic(err)
+	opts := spicy.Options{
+		SpecFile:             f.Arg(0),
+		IncludeFlags:         f.includes,
+		DefineFlags:          f.defines,
+		UndefineFlags:        f.undefines,
+		Cpp:                  newRunner("cpp", *f.cpp_command, *f.cpp_timeout),
+		As:                   newRunner("as", *f.as_command, *f.as_timeout),
+		Ld:                   newRunner("ld", *f.ld_command, *f.ld_timeout),
+		Objcopy:              newRunner("objcopy", *f.objcopy_command, *f.objcopy_timeout),
+		RomHeaderName:        *f.header_filename,
+		BootCodeName:         *f.bootstrap_filename,
+		PifBootCodeName:      *f.pif_bootstrap_filename,
+		Fill:                 byte(*f.filldata),
+		CIC:                  spicy.CIC(*f.cic),
+		DisableOverlapChecks: *f.disable_overlapping_section_check,
+		KeepScratch:          *f.verbose,
 	}
-
-	spec, err := spicy.ParseSpec(preprocessed)
-	if err != nil {
-		panic(err)
-	}
-
-	rom, err := n64rom.NewBlankRomFile(byte(*filldata))
-	if err != nil {
-		panic(err)
-	}
-	for _, w := range spec.Waves {
-		for _, seg := range w.RawSegments {
-			for _, include := range seg.Includes {
-				f, err := os.Open(include)
-				if err != nil {
-					panic(err)
-				}
-				spicy.CreateRawObjectWrapper(f, include+".o", ld)
-			}
-		}
-		entry, err := spicy.CreateEntryBinary(w, as)
+	var cache *spicy.Cache
+	if *f.cache_dir != "" {
+		var err error
+		cache, err = spicy.NewCache(*f.cache_dir)
 		if err != nil {
-			panic(err)
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
 		}
-		linked_object, err := spicy.LinkSpec(w, ld, entry)
+		// cpp isn't cached; the files it includes aren't known up front.
+		opts.As = cache.Wrap(opts.As, *f.as_command)
+		opts.Ld = cache.Wrap(opts.Ld, *f.ld_command)
+		opts.Objcopy = cache.Wrap(opts.Objcopy, *f.objcopy_command)
+	}
+	if *f.map_format != "text" && *f.map_format != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown link map format '%s'\n", *f.map_format)
+		return exitUsage
+	}
+	if f.isSet("pif2boot_file") && !f.isSet("pif2boot_offset") {
+		// Where development boards expect it depends on the board, so
+		// there is no default.
+		fmt.Fprintf(os.Stderr, "--pif2boot_file (-p) needs --pif2boot_offset\n")
+		return exitUsage
+	}
+	opts.PifBootCodeOffset = *f.pif_bootstrap_offset
+	if *f.segments_header != "" {
+		return writeSegmentsHeader(ctx, opts, *f.segments_header)
+	}
+	if *f.romsize_mbits > 0 {
+		opts.RomSizeMbits = *f.romsize_mbits
+	}
+	optionalFiles := []struct {
+		path     string
+		flagName string
+		reader   *io.Reader
+	}{
+		{*f.header_filename, "romheader_file", &opts.RomHeader},
+		{*f.bootstrap_filename, "bootstrap_file", &opts.BootCode},
+		{*f.pif_bootstrap_filename, "pif2boot_file", &opts.PifBootCode},
+		{*f.font_filename, "font_filename", &opts.Font},
+	}
+	for _, o := range optionalFiles {
+		file, err := f.openOptionalFile(o.path, o.flagName)
 		if err != nil {
-			panic(err)
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
 		}
-		binarized_object, err := spicy.BinarizeObject(linked_object, objcopy)
-		if err != nil {
-			panic(err)
+		if file != nil {
+			defer file.Close()
+			*o.reader = file
 		}
+	}
 
-		binarized_object_bytes, err := ioutil.ReadAll(binarized_object)
+	if *f.dry_run {
+		plan, err := spicy.DryRun(ctx, opts, *f.dry_run_dir)
 		if err != nil {
-			panic(err)
+			fmt.Fprintln(os.Stderr, err)
+			return exitCode(err)
 		}
-		rom.WriteAt(binarized_object_bytes, n64rom.CodeStart)
-		if err != nil {
-			panic(err)
+		if err := plan.WriteText(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
 		}
+		return exitOK
+	}
+	result, err := spicy.Build(ctx, opts)
+	if cache != nil {
+		hits, misses := cache.Stats()
+		log.Infof("Tool cache: %d hits, %d misses", hits, misses)
 	}
-	out, err := os.Create(*rom_image_file)
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		return exitCode(err)
 	}
-	// Pad the rom if necessary.
-	if *romsize_mbits > 0 {
-		minSize := int64(1000000 * *romsize_mbits / 8)
-		_, err := out.WriteAt([]byte{0}, minSize)
-		if err != nil {
-			panic(err)
+	err = ioutil.WriteFile(*f.rom_image_file, result.Rom, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if err := writeElfFiles(result.Waves, *f.elf_file); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if *f.link_editor_verbose || *f.map_file != "" {
+		if err := writeLinkMap(result.Waves, *f.map_file, *f.map_format); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitCode(err)
 		}
 	}
-	_, err = rom.Save(out)
+	return exitOK
+}
+
+// writeSegmentsHeader writes the header for --segments_header.
+func writeSegmentsHeader(ctx context.Context, opts spicy.Options, path string) int {
+	spec, err := spicy.LoadSpec(ctx, opts)
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		return exitCode(err)
 	}
-	err = out.Close()
+	var b bytes.Buffer
+	if err := spicy.WriteSegmentsHeader(&b, spec, filepath.Base(opts.SpecFile)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	return exitOK
+}
+
+// elfFileName returns where the linked ELF of the i'th wave is kept: elfFile
+// for the first wave, which the rom boots, and a file named after the wave
+// next to it for the others.
+func elfFileName(elfFile string, w *spicy.Wave, i int) string {
+	if i == 0 {
+		return elfFile
+	}
+	return filepath.Join(filepath.Dir(elfFile), w.Name+filepath.Ext(elfFile))
+}
+
+// writeElfFiles keeps the linked ELF of every wave for --rom_elf_name.
+func writeElfFiles(waves []*spicy.LinkedWave, elfFile string) error {
+	for i, w := range waves {
+		if err := ioutil.WriteFile(elfFileName(elfFile, w.Wave, i), w.Object, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeLinkMap writes the link map to --map_file, or stdout if it isn't set.
+func writeLinkMap(waves []*spicy.LinkedWave, mapFile string, mapFormat string) error {
+	m, err := spicy.NewLinkMap(waves)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	out := os.Stdout
+	if mapFile != "" {
+		out, err = os.Create(mapFile)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	if mapFormat == "json" {
+		return m.WriteJSON(out)
+	}
+	return m.WriteText(out)
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "fmt":
+			os.Exit(runFmt(os.Args[2:]))
+		case "size-diff":
+			os.Exit(runSizeDiff(os.Args[2:]))
+		}
 	}
+	// Interrupting spicy cancels the build, which kills any running tools.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	code := run(ctx, os.Args[1:], execRunner)
+	stop()
+	os.Exit(code)
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trhodeos/spicy"
+)
+
+func TestExitCode(t *testing.T) {
+	toolErr := &spicy.ToolError{Tool: "mips64-elf-ld", Err: errors.New("exit status 1")}
+	assert.Equal(t, exitToolError, exitCode(toolErr))
+	// ld failing while a wave is linked is still a tool error.
+	assert.Equal(t, exitToolError, exitCode(&spicy.LinkError{Wave: "game", Err: toolErr}))
+	assert.Equal(t, exitLinkError, exitCode(&spicy.LinkError{Wave: "game", Err: errors.New("overlap")}))
+	assert.Equal(t, exitSizeError, exitCode(&spicy.SizeError{Err: errors.New("too big")}))
+	assert.Equal(t, exitParseError, exitCode(&spicy.ParseError{Err: errors.New("bad spec")}))
+	assert.Equal(t, exitError, exitCode(errors.New("other")))
+}
+
+func TestWriteElfFilesKeepsEveryWave(t *testing.T) {
+	dir := t.TempDir()
+	waves := []*spicy.LinkedWave{
+		{Wave: &spicy.Wave{Name: "game"}, Object: []byte("first")},
+		{Wave: &spicy.Wave{Name: "overlay"}, Object: []byte("second")},
+	}
+	if !assert.NoError(t, writeElfFiles(waves, filepath.Join(dir, "rom.out"))) {
+		return
+	}
+	for name, want := range map[string]string{"rom.out": "first", "overlay.out": "second"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if assert.NoError(t, err) {
+			assert.Equal(t, want, string(b))
+		}
+	}
+}
+
+// TestReplayBuild runs spicy end to end on the replay test program, with the
+// toolchain runs replayed from the fixtures the spicy package records.
+// testdata links to the spicy package's, so the spec's includes resolve the
+// same way from here.
+func TestReplayBuild(t *testing.T) {
+	assert := assert.New(t)
+	replayDir := filepath.Join("testdata", "replay", "simple")
+	fixtures := filepath.Join(replayDir, "runs")
+	if _, err := os.Stat(fixtures); err != nil {
+		t.Fatalf("No fixtures in %s; record them with go test -record in the spicy package: %s", fixtures, err)
+	}
+	replay := func(tool string, command string, timeout time.Duration) spicy.Runner {
+		return spicy.NewReplayRunner(tool, fixtures)
+	}
+
+	out := t.TempDir()
+	rom := filepath.Join(out, "rom.n64")
+	elfFile := filepath.Join(out, "rom.out")
+	args := []string{"-r", rom, "-e", elfFile, filepath.Join(replayDir, "simple.spec")}
+	if !assert.Equal(exitOK, run(context.Background(), args, replay)) {
+		return
+	}
+
+	b, err := ioutil.ReadFile(rom)
+	if assert.NoError(err) {
+		sum := sha256.Sum256(b)
+		want, err := ioutil.ReadFile(filepath.Join(replayDir, "rom.sha256"))
+		if assert.NoError(err) {
+			assert.Equal(strings.TrimSpace(string(want)), hex.EncodeToString(sum[:]))
+		}
+	}
+	f, err := os.Open(elfFile)
+	if !assert.NoError(err) {
+		return
+	}
+	defer f.Close()
+	symbols, err := spicy.ReadSegmentSymbols(f)
+	if assert.NoError(err) && assert.Contains(symbols, "code") {
+		// The entry point comes first in rom.
+		assert.Equal(uint64(0x1050), symbols["code"].RomStart)
+	}
+}
+
+func TestRunRejectsBadUsage(t *testing.T) {
+	assert.Equal(t, exitUsage, run(context.Background(), nil, execRunner))
+	assert.Equal(t, exitUsage, run(context.Background(), []string{"--no_such_flag", "game.spec"}, execRunner))
+	assert.Equal(t, exitUsage, run(context.Background(), []string{"-p", "pif2Boot", "game.spec"}, execRunner))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	flag "github.com/ogier/pflag"
+	"github.com/trhodeos/spicy"
+	"os"
+)
+
+const (
+	max_growth_text         = "Fail if the total rom size of all segments grows by more than this many bytes. Negative means no limit."
+	max_segment_growth_text = "Fail if the rom size of any one segment grows by more than this many bytes. Negative means no limit."
+)
+
+// runSizeDiff implements 'spicy size-diff [options] <old elf> <new elf>'.
+func runSizeDiff(args []string) int {
+	flags := flag.NewFlagSet("size-diff", flag.ContinueOnError)
+	maxGrowth := flags.Int64("max_growth", -1, max_growth_text)
+	maxSegmentGrowth := flags.Int64("max_segment_growth", -1, max_segment_growth_text)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s size-diff [options] <old elf> <new elf>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	var files []*os.File
+	for _, path := range flags.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+	diff, err := spicy.DiffSizes(files[0], files[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if err := diff.WriteText(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	return checkBudgets(diff, *maxGrowth, *maxSegmentGrowth)
+}
+
+// checkBudgets reports every budget the diff is over. Negative budgets are
+// unlimited.
+func checkBudgets(diff *spicy.SizeDiff, maxGrowth int64, maxSegmentGrowth int64) int {
+	code := exitOK
+	if maxGrowth >= 0 && diff.RomDelta() > maxGrowth {
+		fmt.Fprintf(os.Stderr, "Rom grew by %d bytes, more than the budget of %d bytes\n", diff.RomDelta(), maxGrowth)
+		code = exitSizeError
+	}
+	if maxSegmentGrowth >= 0 {
+		for _, s := range diff.SegmentsOverBudget(maxSegmentGrowth) {
+			fmt.Fprintf(os.Stderr, "Segment %s grew by %d bytes, more than the budget of %d bytes\n", s.Segment, s.Rom(), maxSegmentGrowth)
+			code = exitSizeError
+		}
+	}
+	return code
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trhodeos/spicy"
+)
+
+func TestCheckBudgets(t *testing.T) {
+	diff := &spicy.SizeDiff{Segments: []*spicy.SegmentSizeDelta{
+		{Segment: "code", Old: &spicy.SegmentSymbols{RomEnd: 0x100}, New: &spicy.SegmentSymbols{RomEnd: 0x180}},
+		{Segment: "tex", Old: &spicy.SegmentSymbols{RomEnd: 0x100}, New: &spicy.SegmentSymbols{RomEnd: 0x80}},
+	}}
+	// The total only grew by 0, but code grew by 0x80.
+	assert.Equal(t, exitOK, checkBudgets(diff, 0, -1))
+	assert.Equal(t, exitSizeError, checkBudgets(diff, 0, 0x7f))
+	assert.Equal(t, exitOK, checkBudgets(diff, -1, 0x80))
+}
@@ -0,0 +1,159 @@
+package spicy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The name cpp gives to input read from stdin in its line markers.
+const stdinFilename = "<stdin>"
+
+// Position is a location in the original (pre-cpp) spec source.
+type Position struct {
+	Filename string
+	Line     int
+	Column   int
+}
+
+func (p Position) String() string {
+	// Binary inputs have no lines.
+	if p.Line == 0 {
+		return p.Filename
+	}
+	return fmt.Sprintf("%s:%d:%d", p.Filename, p.Line, p.Column)
+}
+
+// SpecError is an error found while parsing or validating a spec or one of
+// the other text inputs, such as the rom header. Excerpt holds the offending
+// source line, if known.
+type SpecError struct {
+	Pos     Position
+	Msg     string
+	Excerpt string
+}
+
+func newSpecError(pos Position, format string, args ...interface{}) *SpecError {
+	return &SpecError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *SpecError) Error() string {
+	out := fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+	if e.Excerpt == "" {
+		return out
+	}
+	caret := ""
+	if e.Pos.Column > 0 {
+		// Keep tabs so the caret lines up with the excerpt.
+		for i, r := range e.Excerpt {
+			if i >= e.Pos.Column-1 {
+				break
+			}
+			if r == '\t' {
+				caret += "\t"
+			} else {
+				caret += " "
+			}
+		}
+		caret += "^"
+	}
+	return fmt.Sprintf("%s\n%s\n%s", out, e.Excerpt, caret)
+}
+
+// Matches both '# 12 "file" 1 3' and '#line 12 "file"' markers.
+var lineMarkerRegexp = regexp.MustCompile(`^\s*#\s*(?:line\s+)?(\d+)(?:\s+"((?:[^"\\]|\\.)*)")?`)
+
+type sourceLine struct {
+	pos  Position
+	text string
+}
+
+// sourceMap maps lines of preprocessed spec text back to their original
+// location using the line markers cpp emits when run without -P.
+type sourceMap struct {
+	lines []sourceLine
+}
+
+// newSourceMap reads preprocessed spec text, returning the text with all line
+// markers blanked out (so line numbers in it are unchanged) along with a map
+// back to the original files. Input with no markers maps to filename.
+func newSourceMap(r io.Reader, filename string) (*sourceMap, string, error) {
+	m := &sourceMap{}
+	var out strings.Builder
+	file, line := filename, 1
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		text := scanner.Text()
+		if match := lineMarkerRegexp.FindStringSubmatch(text); match != nil {
+			line, _ = strconv.Atoi(match[1])
+			if match[2] != "" {
+				file = match[2]
+				if file == stdinFilename {
+					file = filename
+				}
+			}
+			m.lines = append(m.lines, sourceLine{})
+			out.WriteString("\n")
+			continue
+		}
+		m.lines = append(m.lines, sourceLine{pos: Position{Filename: file, Line: line}, text: text})
+		out.WriteString(text)
+		out.WriteString("\n")
+		line++
+	}
+	return m, out.String(), scanner.Err()
+}
+
+// resolve maps a position in the preprocessed text to the original source.
+func (m *sourceMap) resolve(pos Position) Position {
+	var line sourceLine
+	if pos.Line >= 1 && pos.Line <= len(m.lines) {
+		line = m.lines[pos.Line-1]
+	} else if len(m.lines) > 0 {
+		line = m.lines[len(m.lines)-1]
+	}
+	pos.Filename = line.pos.Filename
+	pos.Line = line.pos.Line
+	return pos
+}
+
+// excerpt returns the text of the source line at pos.
+func (m *sourceMap) excerpt(pos Position) string {
+	for _, l := range m.lines {
+		if l.pos.Filename == pos.Filename && l.pos.Line == pos.Line {
+			return l.text
+		}
+	}
+	return ""
+}
+
+// annotate turns err into a *SpecError carrying an original source position
+// and excerpt, where possible.
+func (m *sourceMap) annotate(err error) error {
+	if e, ok := err.(*SpecError); ok && e.Excerpt == "" {
+		e.Excerpt = m.excerpt(e.Pos)
+	}
+	return err
+}
+
+// resolvePositions rewrites every position in the ast to point at the
+// original source.
+func (m *sourceMap) resolvePositions(s *SpecAst) {
+	resolveStatements := func(statements []*StatementAst) {
+		for _, statement := range statements {
+			statement.Pos = m.resolve(statement.Pos)
+		}
+	}
+	for _, seg := range s.Segments {
+		seg.Pos = m.resolve(seg.Pos)
+		resolveStatements(seg.Statements)
+	}
+	for _, wave := range s.Waves {
+		wave.Pos = m.resolve(wave.Pos)
+		resolveStatements(wave.Statements)
+	}
+}
@@ -0,0 +1,295 @@
+package spicy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/trhodeos/n64rom"
+)
+
+// PlannedCommand is a tool run in a Plan.
+type PlannedCommand struct {
+	// What the command is for.
+	Comment string
+	Command string
+	Args    []string
+	// The files the command reads as stdin and writes its stdout to, if any.
+	Stdin  string
+	Stdout string
+	// The shell variable the command's stdout is assigned to instead, if any.
+	Assign string
+}
+
+// PlannedFile is a file DryRun generated for the commands of a Plan to read.
+type PlannedFile struct {
+	Path     string
+	Contents []byte
+}
+
+// Plan is what Build would run to link the waves of a spec, as worked out by
+// DryRun.
+type Plan struct {
+	Commands []PlannedCommand
+	// The entry source and linker scripts of every wave.
+	Files []PlannedFile
+	// What the plan leaves out compared to a real build.
+	Notes []string
+}
+
+// commandName returns the command r runs, or tool if it can't tell.
+func commandName(r Runner, tool string) string {
+	if c, ok := r.(interface{ Command() string }); ok {
+		return c.Command()
+	}
+	return tool
+}
+
+// DryRun preprocesses and parses the spec in opts and works out the commands
+// Build would run for it, without running anything but cpp. The preprocessed
+// spec, the entry source and linker scripts of every wave and a commands.sh
+// running the plan are written to dir, where the commands also write their
+// outputs. Like LinkWaves, each wave is linked once with placeholders for the
+// wave symbols not known yet and again with the final placement, which the
+// script reads from the link maps.
+func DryRun(ctx context.Context, opts Options, dir string) (*Plan, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	plan := &Plan{}
+	addFile := func(name string, r io.Reader) (string, error) {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return "", err
+		}
+		path := filepath.Join(dir, name)
+		plan.Files = append(plan.Files, PlannedFile{Path: path, Contents: b})
+		return path, ioutil.WriteFile(path, b, 0644)
+	}
+
+	preprocessed, err := preprocessSpecFile(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	preprocessedPath := filepath.Join(dir, filepath.Base(opts.SpecFile)+".i")
+	if err := ioutil.WriteFile(preprocessedPath, preprocessed, 0644); err != nil {
+		return nil, err
+	}
+	plan.Commands = append(plan.Commands, PlannedCommand{
+		Comment: "Preprocess the spec.",
+		Command: commandName(opts.Cpp, "cpp"),
+		Args:    preprocessArgs(opts.IncludeFlags, opts.DefineFlags, opts.UndefineFlags),
+		Stdin:   opts.SpecFile,
+		Stdout:  preprocessedPath,
+	})
+	spec, err := parseSpecFile(preprocessed, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var symbols []Symbol
+	if opts.Font != nil {
+		font, err := LoadFont(opts.Font)
+		if err != nil {
+			return nil, &ParseError{Err: err}
+		}
+		symbols = FontSymbols(font)
+	}
+	as := commandName(opts.As, "as")
+	ld := commandName(opts.Ld, "ld")
+	objcopy := commandName(opts.Objcopy, "objcopy")
+	// Like LinkWaves, wrap the raw segments and assemble the entry point of
+	// every wave before linking any of them.
+	entryObjects := map[*Wave]string{}
+	rawObjects := map[*Wave]map[string]string{}
+	for _, w := range spec.Waves {
+		rawObjects[w] = rawObjectPaths(dir, w)
+		wrapped := map[string]bool{}
+		for _, seg := range w.RawSegments {
+			for _, include := range seg.Includes {
+				if wrapped[include] {
+					continue
+				}
+				wrapped[include] = true
+				plan.Commands = append(plan.Commands, PlannedCommand{
+					Comment: fmt.Sprintf("Wrap include %s of raw segment %s.", include, seg.Name),
+					Command: ld,
+					Args:    rawWrapperArgs(include, rawObjects[w][include]),
+				})
+			}
+		}
+
+		entrySource, err := createEntrySource(w.GetBootSegment())
+		if err != nil {
+			return nil, err
+		}
+		entrySourcePath, err := addFile(w.Name+".entry.s", entrySource)
+		if err != nil {
+			return nil, err
+		}
+		entryObjects[w] = entryObjectPath(dir, w)
+		plan.Commands = append(plan.Commands, PlannedCommand{
+			Comment: fmt.Sprintf("Assemble the entry point of wave %s.", w.Name),
+			Command: as,
+			Args:    entryArgs(entrySourcePath, entryObjects[w]),
+		})
+	}
+
+	// Where a wave is placed depends on how big the waves before it link,
+	// so the wave symbols are shell variables set from the link maps.
+	romStart := func(i int) string {
+		if i == 0 {
+			return fmt.Sprintf("0x%x", n64rom.CodeStart)
+		}
+		return "${" + waveShellVar(spec.Waves[i], "rom_start") + "}"
+	}
+	romEnd := func(i int) string {
+		return "${" + waveShellVar(spec.Waves[i], "rom_end") + "}"
+	}
+	link := func(i int, comment string, scriptName string, provided []Symbol, waves int) error {
+		w := spec.Waves[i]
+		script, err := createLdScript(w, entryObjects[w], rawObjects[w], provided)
+		if err != nil {
+			return err
+		}
+		scriptPath, err := addFile(scriptName, script)
+		if err != nil {
+			return err
+		}
+		defs := defsyms(symbols)
+		for j := 0; j < waves; j++ {
+			defs = append(defs,
+				waveRomStartSymbol(spec.Waves[j])+"="+romStart(j),
+				waveRomEndSymbol(spec.Waves[j])+"="+romEnd(j))
+		}
+		if waves <= i {
+			defs = append(defs, waveRomStartSymbol(w)+"="+romStart(i))
+		}
+		plan.Commands = append(plan.Commands, PlannedCommand{
+			Comment: comment,
+			Command: ld,
+			Args:    linkArgs(scriptPath, filepath.Join(dir, w.Name+".out"), defs),
+			Stdout:  filepath.Join(dir, w.Name+".map"),
+		})
+		return nil
+	}
+	for i, w := range spec.Waves {
+		err := link(i, fmt.Sprintf("Link wave %s, with placeholders for the wave symbols not known yet.", w.Name),
+			w.Name+".ld", wavePlaceholders(spec.Waves, i), i)
+		if err != nil {
+			return nil, err
+		}
+		plan.Commands = append(plan.Commands, PlannedCommand{
+			Comment: fmt.Sprintf("Find where wave %s ends in rom.", w.Name),
+			Command: "sed",
+			Args:    []string{"-n", `s/^ *0x0*\([0-9a-fA-F][0-9a-fA-F]*\) *_RomEnd = .*/0x\1/p`, filepath.Join(dir, w.Name+".map")},
+			Assign:  waveShellVar(w, "rom_end"),
+		})
+		if i+1 < len(spec.Waves) {
+			plan.Commands = append(plan.Commands, PlannedCommand{
+				Comment: fmt.Sprintf("Place wave %s after it.", spec.Waves[i+1].Name),
+				Command: "printf",
+				Args:    []string{"0x%x", fmt.Sprintf("$(( (%s + 0x%x) & ~0x%x ))", romEnd(i), defaultAlignment-1, defaultAlignment-1)},
+				Assign:  waveShellVar(spec.Waves[i+1], "rom_start"),
+			})
+		}
+	}
+	for i, w := range spec.Waves {
+		err := link(i, fmt.Sprintf("Link wave %s again with the final rom placement.", w.Name),
+			w.Name+".final.ld", nil, len(spec.Waves))
+		if err != nil {
+			return nil, err
+		}
+	}
+	plan.Notes = append(plan.Notes, "Build only links a wave again if it refers to its own rom end or the rom range of a later wave; "+
+		"linking it again otherwise gives the same output.")
+	for _, w := range spec.Waves {
+		plan.Commands = append(plan.Commands, PlannedCommand{
+			Comment: fmt.Sprintf("Extract the rom contents of wave %s.", w.Name),
+			Command: objcopy,
+			Args:    binarizeArgs(filepath.Join(dir, w.Name+".out"), binaryPath(dir, w)),
+		})
+	}
+
+	var b bytes.Buffer
+	if err := plan.WriteScript(&b); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "commands.sh"), b.Bytes(), 0755); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+var (
+	shellSafeRegexp      = regexp.MustCompile(`^[A-Za-z0-9_./=,+:@%-]+$`)
+	shellVarUnsafeRegexp = regexp.MustCompile(`[^A-Za-z0-9_]`)
+	shellExpansionRegexp = regexp.MustCompile(`\$\{|\$\(\(`)
+)
+
+// waveShellVar returns the name of the shell variable holding what of w in
+// the plan's script.
+func waveShellVar(w *Wave, what string) string {
+	return shellVarUnsafeRegexp.ReplaceAllString("wave_"+w.Name+"_"+what, "_")
+}
+
+// shellQuote quotes s for the shell. Only the variables and arithmetic the
+// plan uses itself are expanded.
+func shellQuote(s string) string {
+	if shellSafeRegexp.MatchString(s) {
+		return s
+	}
+	if shellExpansionRegexp.MatchString(s) && !strings.ContainsAny(s, "\"\\`") {
+		return `"` + s + `"`
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// WriteScript writes the plan's commands as a shell script.
+func (p *Plan) WriteScript(w io.Writer) error {
+	fmt.Fprintln(w, "#!/bin/sh")
+	fmt.Fprintln(w, "# The commands spicy runs to build the rom. Generated by spicy --dry_run;")
+	fmt.Fprintln(w, "# run it from the directory spicy was run in.")
+	for _, note := range p.Notes {
+		fmt.Fprintf(w, "# Note: %s\n", note)
+	}
+	fmt.Fprintln(w, "set -e")
+	for _, c := range p.Commands {
+		words := []string{shellQuote(c.Command)}
+		for _, arg := range c.Args {
+			words = append(words, shellQuote(arg))
+		}
+		if c.Stdin != "" {
+			words = append(words, "<", shellQuote(c.Stdin))
+		}
+		if c.Stdout != "" {
+			words = append(words, ">", shellQuote(c.Stdout))
+		}
+		line := strings.Join(words, " ")
+		if c.Assign != "" {
+			line = c.Assign + "=$(" + line + ")"
+		}
+		fmt.Fprintf(w, "\n# %s\n%s\n", c.Comment, line)
+	}
+	return nil
+}
+
+// WriteText writes the plan's commands followed by the files they read.
+func (p *Plan) WriteText(w io.Writer) error {
+	if err := p.WriteScript(w); err != nil {
+		return err
+	}
+	for _, f := range p.Files {
+		fmt.Fprintf(w, "\n==> %s <==\n", f.Path)
+		if _, err := w.Write(f.Contents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
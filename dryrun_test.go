@@ -0,0 +1,190 @@
+package spicy
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const dryRunSpec = `beginseg
+	name	"code"
+	flags	BOOT OBJECT
+	entry	boot
+	stack	boot_stack + 0x2000
+	include	"code.o"
+endseg
+
+beginseg
+	name	"tex"
+	flags	RAW
+	include	"tex.bin"
+endseg
+
+beginwave
+	name	"first"
+	include	"code"
+	include	"tex"
+endwave
+
+beginwave
+	name	"second"
+	include	"code"
+endwave
+`
+
+func TestDryRunPlansCommands(t *testing.T) {
+	assert := assert.New(t)
+	specFile := filepath.Join(t.TempDir(), "game.spec")
+	assert.NoError(ioutil.WriteFile(specFile, []byte(dryRunSpec), 0644))
+	dir := filepath.Join(t.TempDir(), "plan")
+	// Only cpp may run; the other tools don't exist.
+	opts := Options{
+		SpecFile: specFile,
+		Cpp:      catRunner{},
+		As:       NewRunner("no-such-as"),
+		Ld:       NewRunner("no-such-ld"),
+		Objcopy:  NewRunner("no-such-objcopy"),
+	}
+	plan, err := DryRun(context.Background(), opts, dir)
+	if !assert.NoError(err) {
+		return
+	}
+
+	var commands []string
+	for _, c := range plan.Commands {
+		commands = append(commands, c.Command+" "+strings.Join(c.Args, " "))
+	}
+	ld := func(wave string, script string, defsyms ...string) string {
+		args := append([]string{"no-such-ld"}, ldArgs...)
+		for _, d := range defsyms {
+			args = append(args, "--defsym", d)
+		}
+		return strings.Join(append(args, "-dT", filepath.Join(dir, script), "-o", filepath.Join(dir, wave+".out")), " ")
+	}
+	findEnd := func(wave string) string {
+		return `sed -n s/^ *0x0*\([0-9a-fA-F][0-9a-fA-F]*\) *_RomEnd = .*/0x\1/p ` + filepath.Join(dir, wave+".map")
+	}
+	assert.Equal([]string{
+		"cpp -E -U_LANGUAGE_C -D_LANGUAGE_MAKEROM -",
+		"no-such-ld -r -b binary -o " + filepath.Join(dir, "first.tex.0.o") + " tex.bin",
+		"no-such-as " + strings.Join(compileArgs, " ") + " -o " + filepath.Join(dir, "first.entry.o") + " " + filepath.Join(dir, "first.entry.s"),
+		"no-such-as " + strings.Join(compileArgs, " ") + " -o " + filepath.Join(dir, "second.entry.o") + " " + filepath.Join(dir, "second.entry.s"),
+		ld("first", "first.ld", "_firstWaveRomStart=0x1000"),
+		findEnd("first"),
+		"printf 0x%x $(( (${wave_first_rom_end} + 0xf) & ~0xf ))",
+		ld("second", "second.ld", "_firstWaveRomStart=0x1000", "_firstWaveRomEnd=${wave_first_rom_end}", "_secondWaveRomStart=${wave_second_rom_start}"),
+		findEnd("second"),
+		ld("first", "first.final.ld", "_firstWaveRomStart=0x1000", "_firstWaveRomEnd=${wave_first_rom_end}",
+			"_secondWaveRomStart=${wave_second_rom_start}", "_secondWaveRomEnd=${wave_second_rom_end}"),
+		ld("second", "second.final.ld", "_firstWaveRomStart=0x1000", "_firstWaveRomEnd=${wave_first_rom_end}",
+			"_secondWaveRomStart=${wave_second_rom_start}", "_secondWaveRomEnd=${wave_second_rom_end}"),
+		"no-such-objcopy -O binary " + filepath.Join(dir, "first.out") + " " + filepath.Join(dir, "first.bin"),
+		"no-such-objcopy -O binary " + filepath.Join(dir, "second.out") + " " + filepath.Join(dir, "second.bin"),
+	}, commands)
+	assert.Len(plan.Notes, 1)
+
+	for _, name := range []string{"game.spec.i", "commands.sh", "first.entry.s", "first.ld", "first.final.ld", "second.entry.s", "second.ld", "second.final.ld"} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		assert.NoError(err, name)
+	}
+	script, err := ioutil.ReadFile(filepath.Join(dir, "first.ld"))
+	if assert.NoError(err) {
+		assert.Contains(string(script), filepath.Join(dir, "first.entry.o"))
+		assert.Contains(string(script), filepath.Join(dir, "first.tex.0.o"))
+		assert.Contains(string(script), "PROVIDE(_secondWaveRomStart = 0x0);")
+	}
+	script, err = ioutil.ReadFile(filepath.Join(dir, "first.final.ld"))
+	if assert.NoError(err) {
+		assert.NotContains(string(script), "PROVIDE")
+	}
+
+	var text bytes.Buffer
+	assert.NoError(plan.WriteText(&text))
+	assert.Contains(text.String(), "'-G 0'")
+	assert.Contains(text.String(), "< "+specFile+" > "+filepath.Join(dir, "game.spec.i"))
+	assert.Contains(text.String(), "==> "+filepath.Join(dir, "first.entry.s")+" <==")
+	assert.Contains(text.String(), "la	$10, boot + 0")
+}
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, "-o", shellQuote("-o"))
+	assert.Equal(t, "'-G 0'", shellQuote("-G 0"))
+	assert.Equal(t, `'it'\''s'`, shellQuote("it's"))
+	assert.Equal(t, `"_aWaveRomEnd=${wave_a_rom_end}"`, shellQuote("_aWaveRomEnd=${wave_a_rom_end}"))
+	assert.Equal(t, `'$(ROOT)/usr/lib/PR/rspboot.o'`, shellQuote("$(ROOT)/usr/lib/PR/rspboot.o"))
+}
+
+// fakeTool writes a shell script standing in for a tool to dir.
+func fakeTool(t *testing.T, dir string, name string, script string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// namedCatRunner preprocesses like catRunner, but plans command.
+type namedCatRunner struct {
+	catRunner
+	command string
+}
+
+func (r namedCatRunner) Command() string {
+	return r.command
+}
+
+func TestDryRunScriptPlacesWaves(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	assert := assert.New(t)
+	work := t.TempDir()
+	assert.NoError(ioutil.WriteFile(filepath.Join(work, "game.spec"), []byte(dryRunSpec), 0644))
+	bin := t.TempDir()
+	log := filepath.Join(work, "ld.log")
+	// Every tool writes the file after -o, or its last argument. ld logs how
+	// it was run and prints where the wave ends like ld -M does.
+	touchOutput := `out=; prev=; for a in "$@"; do [ "$prev" = -o ] && out=$a; prev=$a; done; [ -n "$out" ] || out=$a; : > "$out"` + "\n"
+	opts := Options{
+		SpecFile: filepath.Join(work, "game.spec"),
+		Cpp:      namedCatRunner{command: fakeTool(t, bin, "cpp", "cat\n")},
+		As:       NewRunner(fakeTool(t, bin, "as", touchOutput)),
+		Ld: NewRunner(fakeTool(t, bin, "ld", touchOutput+`echo "$@" >> `+log+`
+case "$out" in
+*first.out) echo "                0x00002234                _RomEnd = _RomSize" ;;
+*second.out) echo "                0x00002a40                _RomEnd = _RomSize" ;;
+esac
+`)),
+		Objcopy: NewRunner(fakeTool(t, bin, "objcopy", touchOutput)),
+	}
+	dir := filepath.Join(work, "plan")
+	if _, err := DryRun(context.Background(), opts, dir); !assert.NoError(err) {
+		return
+	}
+
+	cmd := exec.Command("sh", filepath.Join(dir, "commands.sh"))
+	cmd.Dir = work
+	if out, err := cmd.CombinedOutput(); !assert.NoError(err, string(out)) {
+		return
+	}
+	b, err := ioutil.ReadFile(log)
+	if !assert.NoError(err) {
+		return
+	}
+	links := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if assert.Len(links, 5) {
+		assert.Contains(links[2], "--defsym _firstWaveRomEnd=0x2234 --defsym _secondWaveRomStart=0x2240 -dT")
+		assert.Contains(links[3], "--defsym _secondWaveRomStart=0x2240 --defsym _secondWaveRomEnd=0x2a40 -dT "+filepath.Join(dir, "first.final.ld"))
+	}
+	for _, name := range []string{"first.bin", "second.bin"} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		assert.NoError(err, name)
+	}
+}
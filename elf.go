@@ -0,0 +1,116 @@
+package spicy
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// SegmentSymbols holds the values of the symbols the generated linker script
+// defines for a segment. Symbols that aren't defined are left as zero.
+type SegmentSymbols struct {
+	RomStart  uint64 `json:"rom_start"`
+	RomEnd    uint64 `json:"rom_end"`
+	TextStart uint64 `json:"text_start"`
+	TextEnd   uint64 `json:"text_end"`
+	DataStart uint64 `json:"data_start"`
+	DataEnd   uint64 `json:"data_end"`
+	BssStart  uint64 `json:"bss_start"`
+	BssEnd    uint64 `json:"bss_end"`
+}
+
+// RomSize is the number of bytes the segment occupies in ROM.
+func (s *SegmentSymbols) RomSize() uint64 {
+	return s.RomEnd - s.RomStart
+}
+
+// BssSize is the number of bytes of bss the segment needs at runtime.
+func (s *SegmentSymbols) BssSize() uint64 {
+	return s.BssEnd - s.BssStart
+}
+
+var segmentSymbolRegexp = regexp.MustCompile(`^_(.+)Segment(RomStart|RomEnd|TextStart|TextEnd|DataStart|DataEnd|BssStart|BssEnd)$`)
+
+// ReadSegmentSymbols reads the per-segment symbols out of a linked ELF file,
+// keyed by segment name.
+func ReadSegmentSymbols(r io.ReaderAt) (map[string]*SegmentSymbols, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	symbols, err := f.Symbols()
+	if err != nil {
+		return nil, err
+	}
+	return segmentSymbolsFrom(symbols), nil
+}
+
+func segmentSymbolsFrom(symbols []elf.Symbol) map[string]*SegmentSymbols {
+	out := map[string]*SegmentSymbols{}
+	for _, sym := range symbols {
+		match := segmentSymbolRegexp.FindStringSubmatch(sym.Name)
+		if match == nil {
+			continue
+		}
+		seg := out[match[1]]
+		if seg == nil {
+			seg = &SegmentSymbols{}
+			out[match[1]] = seg
+		}
+		switch match[2] {
+		case "RomStart":
+			seg.RomStart = sym.Value
+		case "RomEnd":
+			seg.RomEnd = sym.Value
+		case "TextStart":
+			seg.TextStart = sym.Value
+		case "TextEnd":
+			seg.TextEnd = sym.Value
+		case "DataStart":
+			seg.DataStart = sym.Value
+		case "DataEnd":
+			seg.DataEnd = sym.Value
+		case "BssStart":
+			seg.BssStart = sym.Value
+		case "BssEnd":
+			seg.BssEnd = sym.Value
+		}
+	}
+	return out
+}
+
+// ReadSymbols returns the values of the named symbols in an ELF file.
+func ReadSymbols(r io.ReaderAt) (map[string]uint64, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	symbols, err := f.Symbols()
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]uint64{}
+	for _, sym := range symbols {
+		if sym.Name != "" {
+			out[sym.Name] = sym.Value
+		}
+	}
+	return out, nil
+}
+
+// ReadSymbol returns the value of the named symbol in an ELF file.
+func ReadSymbol(r io.ReaderAt, name string) (uint64, error) {
+	symbols, err := ReadSymbols(r)
+	if err != nil {
+		return 0, err
+	}
+	value, ok := symbols[name]
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("Symbol %s not found", name))
+	}
+	return value, nil
+}
@@ -0,0 +1,173 @@
+package spicy
+
+import (
+	"debug/elf"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ElfReport summarizes an ELF file, such as a linked wave, for print_elf.
+type ElfReport struct {
+	Sections []ElfSection `json:"sections,omitempty"`
+	Programs []ElfProgram `json:"programs,omitempty"`
+	Symbols  []ElfSymbol  `json:"symbols,omitempty"`
+	// The spicy segments found in the file, in rom order.
+	Segments []*ElfSegment `json:"segments"`
+}
+
+type ElfSection struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Flags  string `json:"flags"`
+	Addr   uint64 `json:"addr"`
+	Offset uint64 `json:"offset"`
+	Size   uint64 `json:"size"`
+}
+
+type ElfProgram struct {
+	Type   string `json:"type"`
+	Flags  string `json:"flags"`
+	Offset uint64 `json:"offset"`
+	Vaddr  uint64 `json:"vaddr"`
+	Paddr  uint64 `json:"paddr"`
+	Filesz uint64 `json:"filesz"`
+	Memsz  uint64 `json:"memsz"`
+}
+
+type ElfSymbol struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Bind    string `json:"bind"`
+	Section string `json:"section"`
+	Value   uint64 `json:"value"`
+	Size    uint64 `json:"size"`
+}
+
+// ElfSegment is a spicy segment recognized by its ..name and ..name.bss
+// sections and its _<name>Segment* symbols.
+type ElfSegment struct {
+	Name     string         `json:"name"`
+	Sections []string       `json:"sections"`
+	Bounds   SegmentSymbols `json:"bounds"`
+	// The other symbols defined in the segment's sections, sorted by name.
+	Symbols []string `json:"symbols"`
+}
+
+// ReadElfReport reads the report of an ELF file.
+func ReadElfReport(r io.ReaderAt) (*ElfReport, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	symbols, err := f.Symbols()
+	// Stripped files have no symbols, which is fine here.
+	if err != nil && err != elf.ErrNoSymbols {
+		return nil, err
+	}
+	return elfReportFrom(f.Sections, f.Progs, symbols), nil
+}
+
+func elfReportFrom(sections []*elf.Section, progs []*elf.Prog, symbols []elf.Symbol) *ElfReport {
+	out := &ElfReport{}
+	segments := map[string]*ElfSegment{}
+	segment := func(name string) *ElfSegment {
+		seg := segments[name]
+		if seg == nil {
+			seg = &ElfSegment{Name: name}
+			segments[name] = seg
+		}
+		return seg
+	}
+
+	for _, s := range sections {
+		out.Sections = append(out.Sections, ElfSection{
+			Name:   s.Name,
+			Type:   s.Type.String(),
+			Flags:  s.Flags.String(),
+			Addr:   s.Addr,
+			Offset: s.Offset,
+			Size:   s.Size,
+		})
+		if name := segmentOfSection(s.Name); name != "" {
+			seg := segment(name)
+			seg.Sections = append(seg.Sections, s.Name)
+		}
+	}
+	for _, p := range progs {
+		out.Programs = append(out.Programs, ElfProgram{
+			Type:   p.Type.String(),
+			Flags:  p.Flags.String(),
+			Offset: p.Off,
+			Vaddr:  p.Vaddr,
+			Paddr:  p.Paddr,
+			Filesz: p.Filesz,
+			Memsz:  p.Memsz,
+		})
+	}
+
+	for name, bounds := range segmentSymbolsFrom(symbols) {
+		segment(name).Bounds = *bounds
+	}
+	for _, sym := range symbols {
+		section := sectionName(sections, sym.Section)
+		out.Symbols = append(out.Symbols, ElfSymbol{
+			Name:    sym.Name,
+			Type:    elf.ST_TYPE(sym.Info).String(),
+			Bind:    elf.ST_BIND(sym.Info).String(),
+			Section: section,
+			Value:   sym.Value,
+			Size:    sym.Size,
+		})
+		typ := elf.ST_TYPE(sym.Info)
+		if sym.Name == "" || typ == elf.STT_SECTION || typ == elf.STT_FILE ||
+			segmentSymbolRegexp.MatchString(sym.Name) || otherSegmentSymbolRegexp.MatchString(sym.Name) {
+			continue
+		}
+		if name := segmentOfSection(section); name != "" {
+			seg := segment(name)
+			seg.Symbols = append(seg.Symbols, sym.Name)
+		}
+	}
+
+	for _, seg := range segments {
+		sort.Strings(seg.Symbols)
+		out.Segments = append(out.Segments, seg)
+	}
+	sort.Slice(out.Segments, func(i, j int) bool {
+		a, b := out.Segments[i], out.Segments[j]
+		if a.Bounds.RomStart != b.Bounds.RomStart {
+			return a.Bounds.RomStart < b.Bounds.RomStart
+		}
+		return a.Name < b.Name
+	})
+	return out
+}
+
+// entrySection is the section the linker script puts the generated entry
+// point in. It isn't a segment of the spec.
+const entrySection = "..generatedStartEntry"
+
+// segmentOfSection returns the segment a section created by the linker
+// script belongs to, or "" if it isn't one of them.
+func segmentOfSection(name string) string {
+	if !strings.HasPrefix(name, "..") || name == entrySection {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(name, ".."), ".bss")
+}
+
+func sectionName(sections []*elf.Section, i elf.SectionIndex) string {
+	switch {
+	case i == elf.SHN_UNDEF:
+		return "UND"
+	case i == elf.SHN_ABS:
+		return "ABS"
+	case i == elf.SHN_COMMON:
+		return "COM"
+	case int(i) < len(sections):
+		return sections[i].Name
+	}
+	return i.String()
+}
@@ -0,0 +1,67 @@
+package spicy
+
+import (
+	"debug/elf"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestElfReportGroupsSegments(t *testing.T) {
+	assert := assert.New(t)
+	section := func(name string, addr uint64) *elf.Section {
+		return &elf.Section{SectionHeader: elf.SectionHeader{Name: name, Type: elf.SHT_PROGBITS, Addr: addr}}
+	}
+	sections := []*elf.Section{
+		section("", 0),
+		section("..code", 0x80000400),
+		section("..code.bss", 0x80000500),
+		section("..tex", 0x80000600),
+		section("..generatedStartEntry", 0x80000400),
+		section(".comment", 0),
+	}
+	global := elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC)
+	symbols := []elf.Symbol{
+		{Name: "_codeSegmentRomStart", Value: 0x1000, Section: elf.SHN_ABS},
+		{Name: "_codeSegmentTextStart", Value: 0x80000400, Section: 1},
+		{Name: "_codeSegmentBssStart", Value: 0x80000500, Section: 2},
+		{Name: "_codeSegmentBssSize", Value: 0x10, Section: elf.SHN_ABS},
+		{Name: "_texSegmentRomStart", Value: 0x1100, Section: elf.SHN_ABS},
+		{Name: "main", Info: global, Value: 0x80000400, Section: 1},
+		{Name: "_start", Info: global, Value: 0x80000400, Section: 4},
+		{Name: "buffer", Info: global, Value: 0x80000500, Section: 2},
+		{Name: "code.c", Info: elf.ST_INFO(elf.STB_LOCAL, elf.STT_FILE), Section: elf.SHN_ABS},
+		{Name: "puts", Info: global, Section: elf.SHN_UNDEF},
+	}
+	progs := []*elf.Prog{{ProgHeader: elf.ProgHeader{Type: elf.PT_LOAD, Vaddr: 0x80000400, Filesz: 0x100}}}
+	r := elfReportFrom(sections, progs, symbols)
+
+	assert.Len(r.Sections, 6)
+	assert.Equal("SHT_PROGBITS", r.Sections[1].Type)
+	assert.Equal([]ElfProgram{{Type: "PT_LOAD", Flags: "0x0", Vaddr: 0x80000400, Filesz: 0x100}}, r.Programs)
+	assert.Len(r.Symbols, 10)
+	assert.Equal("ABS", r.Symbols[0].Section)
+	assert.Equal("..code", r.Symbols[5].Section)
+	assert.Equal("..generatedStartEntry", r.Symbols[6].Section)
+	assert.Equal("UND", r.Symbols[9].Section)
+
+	if assert.Len(r.Segments, 2) {
+		code := r.Segments[0]
+		assert.Equal("code", code.Name)
+		assert.Equal([]string{"..code", "..code.bss"}, code.Sections)
+		assert.Equal(uint64(0x1000), code.Bounds.RomStart)
+		assert.Equal(uint64(0x80000500), code.Bounds.BssStart)
+		assert.Equal([]string{"buffer", "main"}, code.Symbols)
+		assert.Equal("tex", r.Segments[1].Name)
+	}
+}
+
+func TestElfReportJSONUsesSnakeCaseBounds(t *testing.T) {
+	b, err := json.Marshal(&ElfSegment{Name: "code", Bounds: SegmentSymbols{RomStart: 0x1000, BssEnd: 0x80000500}})
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(b), `"bounds":{"rom_start":4096,"rom_end":0,`)
+		assert.Contains(t, string(b), `"bss_end":2147484928}`)
+		assert.NotContains(t, string(b), "RomStart")
+	}
+}
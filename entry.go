@@ -2,6 +2,7 @@ package spicy
 
 import (
 	"bytes"
+	"context"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"text/template"
@@ -36,12 +37,22 @@ _start:
 	return b, err
 }
 
-func CreateEntryBinary(w *Wave, as Runner) (io.Reader, error) {
+func entryArgs(source string, output string) []string {
+	return append(append([]string{}, compileArgs...), "-o", output, source)
+}
+
+// CreateEntryBinary assembles the entry point of the wave into an object in
+// the scratch directory dir.
+func CreateEntryBinary(ctx context.Context, dir string, w *Wave, as Runner) (io.Reader, error) {
 	name := w.Name
 	log.Infof("Creating entry for \"%s\".", name)
 	entrySource, err := createEntrySource(w.GetBootSegment())
 	if err != nil {
 		return nil, err
 	}
-	return NewOutputFileRunner(as, "a.out").Run(entrySource, append(compileArgs, "-"))
+	output := entryObjectPath(dir, w)
+	mappedInputs := map[string]io.Reader{
+		"entry.s": entrySource,
+	}
+	return NewMappedFileRunner(as, mappedInputs, output).InDir(dir).RunContext(ctx, nil /* stdin */, entryArgs("entry.s", output))
 }
@@ -0,0 +1,57 @@
+package spicy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseError is returned by Build when the spec or one of the other inputs
+// (rom header, boot code, font) is malformed or invalid.
+type ParseError struct {
+	Err error
+}
+
+func (e *ParseError) Error() string { return e.Err.Error() }
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// ToolError is returned when an external tool (cpp, as, ld or objcopy)
+// fails.
+type ToolError struct {
+	Tool   string
+	Args   []string
+	Stderr string
+	Err    error
+}
+
+func (e *ToolError) Error() string {
+	msg := strings.TrimSpace(e.Stderr)
+	if msg == "" && e.Err != nil {
+		msg = e.Err.Error()
+	}
+	return fmt.Sprintf("Error running '%s': %s", e.Tool, msg)
+}
+
+func (e *ToolError) Unwrap() error { return e.Err }
+
+// LinkError is returned by Build when a wave fails to link, or links into
+// something that can't be used, such as overlapping segments. When as or ld
+// failed, Err is the *ToolError.
+type LinkError struct {
+	Wave string
+	Err  error
+}
+
+func (e *LinkError) Error() string {
+	return fmt.Sprintf("Linking wave %s: %s", e.Wave, e.Err)
+}
+
+func (e *LinkError) Unwrap() error { return e.Err }
+
+// SizeError is returned by Build when a segment outgrows its maxsize or the
+// rom outgrows the requested rom size.
+type SizeError struct {
+	Err error
+}
+
+func (e *SizeError) Error() string { return e.Err.Error() }
+func (e *SizeError) Unwrap() error { return e.Err }
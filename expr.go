@@ -0,0 +1,222 @@
+package spicy
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Expression is a C-style integer expression. The parser only records the
+// flat sequence of operators; precedence is applied during evaluation.
+type Expression struct {
+	Lhs  *UnaryExpr
+	Rest []*BinaryOp
+}
+
+type BinaryOp struct {
+	Op  string
+	Rhs *UnaryExpr
+}
+
+type UnaryExpr struct {
+	Op      string
+	Operand *Operand
+}
+
+type Operand struct {
+	Int    string
+	Symbol string
+	Sub    *Expression
+}
+
+// exprValue is the result of evaluating an expression: a constant, optionally
+// relative to a single link-time symbol. Values are unsigned 64-bit, like
+// the addresses and sizes they describe, so going below zero is an error.
+type exprValue struct {
+	Symbol string
+	Offset uint64
+}
+
+var errOverflow = errors.New("integer overflow")
+
+func addUint64(a, b uint64) (uint64, error) {
+	c := a + b
+	if c < a {
+		return 0, errOverflow
+	}
+	return c, nil
+}
+
+func subUint64(a, b uint64) (uint64, error) {
+	if b > a {
+		return 0, errors.New(fmt.Sprintf("Value 0x%x - 0x%x must not be negative", a, b))
+	}
+	return a - b, nil
+}
+
+func mulUint64(a, b uint64) (uint64, error) {
+	if a == 0 || b == 0 {
+		return 0, nil
+	}
+	c := a * b
+	if c/b != a {
+		return 0, errOverflow
+	}
+	return c, nil
+}
+
+func constantOp(op string, lhs, rhs exprValue) (exprValue, error) {
+	if lhs.Symbol != "" || rhs.Symbol != "" {
+		return exprValue{}, errors.New(fmt.Sprintf("Symbols can only be offset with + or -, not '%s'", op))
+	}
+	a, b := lhs.Offset, rhs.Offset
+	var c uint64
+	var err error
+	switch op {
+	case "*":
+		c, err = mulUint64(a, b)
+	case "/", "%":
+		if b == 0 {
+			return exprValue{}, errors.New("Division by zero")
+		}
+		if op == "/" {
+			c = a / b
+		} else {
+			c = a % b
+		}
+	case "<<":
+		if b > 63 {
+			return exprValue{}, errors.New(fmt.Sprintf("Invalid shift count %d", b))
+		}
+		c = a << b
+		if c>>b != a {
+			err = errOverflow
+		}
+	case ">>":
+		if b > 63 {
+			return exprValue{}, errors.New(fmt.Sprintf("Invalid shift count %d", b))
+		}
+		c = a >> b
+	case "&":
+		c = a & b
+	case "|":
+		c = a | b
+	default:
+		return exprValue{}, errors.New(fmt.Sprintf("Unknown operator '%s'", op))
+	}
+	return exprValue{Offset: c}, err
+}
+
+func binaryOp(op string, lhs, rhs exprValue) (exprValue, error) {
+	var err error
+	switch op {
+	case "+":
+		if lhs.Symbol != "" && rhs.Symbol != "" {
+			return exprValue{}, errors.New(fmt.Sprintf("Cannot add symbols %s and %s", lhs.Symbol, rhs.Symbol))
+		}
+		out := exprValue{Symbol: lhs.Symbol + rhs.Symbol}
+		out.Offset, err = addUint64(lhs.Offset, rhs.Offset)
+		return out, err
+	case "-":
+		if rhs.Symbol != "" {
+			return exprValue{}, errors.New(fmt.Sprintf("Cannot subtract symbol %s", rhs.Symbol))
+		}
+		out := exprValue{Symbol: lhs.Symbol}
+		out.Offset, err = subUint64(lhs.Offset, rhs.Offset)
+		return out, err
+	}
+	return constantOp(op, lhs, rhs)
+}
+
+// Binding strength of each binary operator, as in C.
+var precedence = map[string]int{
+	"|":  1,
+	"&":  2,
+	"<<": 3,
+	">>": 3,
+	"+":  4,
+	"-":  4,
+	"*":  5,
+	"/":  5,
+	"%":  5,
+}
+
+func (e *Expression) eval() (exprValue, error) {
+	lhs, err := e.Lhs.eval()
+	if err != nil {
+		return exprValue{}, err
+	}
+	rest := e.Rest
+	return evalBinary(lhs, &rest, 1)
+}
+
+// evalBinary consumes operators from rest with at least minPrecedence,
+// applying them left-associatively to lhs (precedence climbing).
+func evalBinary(lhs exprValue, rest *[]*BinaryOp, minPrecedence int) (exprValue, error) {
+	for len(*rest) > 0 && precedence[(*rest)[0].Op] >= minPrecedence {
+		op := (*rest)[0]
+		*rest = (*rest)[1:]
+		rhs, err := op.Rhs.eval()
+		if err != nil {
+			return exprValue{}, err
+		}
+		for len(*rest) > 0 && precedence[(*rest)[0].Op] > precedence[op.Op] {
+			rhs, err = evalBinary(rhs, rest, precedence[op.Op]+1)
+			if err != nil {
+				return exprValue{}, err
+			}
+		}
+		lhs, err = binaryOp(op.Op, lhs, rhs)
+		if err != nil {
+			return exprValue{}, err
+		}
+	}
+	return lhs, nil
+}
+
+func (e *UnaryExpr) eval() (exprValue, error) {
+	v, err := e.Operand.eval()
+	if err != nil || e.Op == "" || e.Op == "+" {
+		return v, err
+	}
+	if v.Symbol != "" {
+		return exprValue{}, errors.New(fmt.Sprintf("Cannot apply '%s' to symbol %s", e.Op, v.Symbol))
+	}
+	if e.Op == "~" {
+		return exprValue{Offset: ^v.Offset}, nil
+	}
+	if v.Offset != 0 {
+		return exprValue{}, errors.New(fmt.Sprintf("Value -0x%x must not be negative", v.Offset))
+	}
+	return v, nil
+}
+
+func (o *Operand) eval() (exprValue, error) {
+	switch {
+	case o.Sub != nil:
+		return o.Sub.eval()
+	case o.Symbol != "":
+		return exprValue{Symbol: o.Symbol}, nil
+	}
+	// Base 0 handles hex, octal and decimal like cpp does.
+	i, err := strconv.ParseUint(o.Int, 0, 64)
+	if err != nil {
+		if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+			return exprValue{}, errors.New(fmt.Sprintf("Constant %s overflows 64 bits", o.Int))
+		}
+		return exprValue{}, errors.New(fmt.Sprintf("Invalid constant %s", o.Int))
+	}
+	return exprValue{Offset: i}, nil
+}
+
+// evalConstant evaluates e, which must not reference any symbols.
+func (e *Expression) evalConstant() (uint64, error) {
+	v, err := e.eval()
+	if err != nil {
+		return 0, err
+	}
+	if v.Symbol != "" {
+		return 0, errors.New(fmt.Sprintf("Expected a constant, found symbol %s", v.Symbol))
+	}
+	return v.Offset, nil
+}
@@ -0,0 +1,35 @@
+package spicy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// FontStart is where makerom places the font, in the tail of the boot code
+// region that the boot code itself doesn't use.
+const FontStart = 0xB70
+
+// FontMaxSize is the space available for the font before code starts.
+const FontMaxSize = 0x1000 - FontStart
+
+// LoadFont reads font data to place in the rom at FontStart.
+func LoadFont(r io.Reader) ([]byte, error) {
+	font, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(font) == 0 || len(font) > FontMaxSize {
+		return nil, errors.New(fmt.Sprintf("Font must be between 1 and %d bytes, found %d", FontMaxSize, len(font)))
+	}
+	return font, nil
+}
+
+// FontSymbols returns the linker symbols giving the rom location of a font.
+func FontSymbols(font []byte) []Symbol {
+	return []Symbol{
+		{Name: "_FontRomStart", Value: FontStart},
+		{Name: "_FontRomEnd", Value: FontStart + uint64(len(font))},
+	}
+}
@@ -0,0 +1,180 @@
+package spicy
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The order statements are written in by FormatSpec. Statements with the
+// same rank, such as includes, keep their order.
+var statementRank = map[string]int{
+	"name":    0,
+	"flags":   1,
+	"address": 2,
+	"after":   2,
+	"number":  2,
+	"align":   3,
+	"maxsize": 4,
+	"entry":   5,
+	"stack":   6,
+	"include": 7,
+}
+
+// FormatSpec rewrites spec source (before preprocessing) in the canonical
+// layout, keeping its comments and cpp directives.
+func FormatSpec(src []byte, filename string) ([]byte, error) {
+	sources, _, err := newSourceMap(bytes.NewReader(src), filename)
+	if err != nil {
+		return nil, err
+	}
+	ast, err := parseSpecAst(string(src), filename)
+	if err != nil {
+		return nil, sources.annotate(err)
+	}
+
+	// Blocks are written in source order, which needn't be all segments
+	// followed by all waves.
+	type block struct {
+		pos   Position
+		write func(*bytes.Buffer)
+	}
+	var blocks []block
+	for _, seg := range ast.Segments {
+		seg := seg
+		blocks = append(blocks, block{seg.Pos, func(b *bytes.Buffer) {
+			writeBlock(b, "beginseg", "endseg", seg.Comments, seg.Statements, seg.End)
+		}})
+	}
+	for _, wave := range ast.Waves {
+		wave := wave
+		blocks = append(blocks, block{wave.Pos, func(b *bytes.Buffer) {
+			writeBlock(b, "beginwave", "endwave", wave.Comments, wave.Statements, wave.End)
+		}})
+	}
+	sort.SliceStable(blocks, func(i, j int) bool {
+		a, b := blocks[i].pos, blocks[j].pos
+		return a.Line < b.Line || (a.Line == b.Line && a.Column < b.Column)
+	})
+
+	var b bytes.Buffer
+	for i, block := range blocks {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		block.write(&b)
+	}
+	if len(ast.End.Leading) > 0 && len(blocks) > 0 {
+		b.WriteString("\n")
+	}
+	writeComments(&b, "", ast.End.Leading)
+	return b.Bytes(), nil
+}
+
+func writeBlock(b *bytes.Buffer, begin string, end string, comments Comments, statements []*StatementAst, endComments Comments) {
+	writeComments(b, "", comments.Leading)
+	writeLine(b, "", begin, comments.Trailing)
+	// Statements are never moved across a directive, so conditionals keep
+	// guarding the same statements.
+	start := 0
+	for i := range statements {
+		if i+1 == len(statements) || hasDirective(statements[i+1].Leading) {
+			group := append([]*StatementAst{}, statements[start:i+1]...)
+			sort.SliceStable(group, func(x, y int) bool {
+				return statementRank[group[x].Name] < statementRank[group[y].Name]
+			})
+			for _, s := range group {
+				writeComments(b, "\t", s.Leading)
+				writeLine(b, "\t", s.Name+" "+formatValue(s), s.Trailing)
+			}
+			start = i + 1
+		}
+	}
+	writeComments(b, "\t", endComments.Leading)
+	writeLine(b, "", end, endComments.Trailing)
+}
+
+func hasDirective(comments []string) bool {
+	for _, c := range comments {
+		if strings.HasPrefix(c, "#") {
+			return true
+		}
+	}
+	return false
+}
+
+func writeLine(b *bytes.Buffer, indent string, text string, trailing string) {
+	b.WriteString(indent)
+	b.WriteString(text)
+	if trailing != "" {
+		b.WriteString(" ")
+		b.WriteString(trailing)
+	}
+	b.WriteString("\n")
+}
+
+// writeComments writes comments at the given indent. Directives always start
+// at the beginning of the line, as cpp requires on some platforms.
+func writeComments(b *bytes.Buffer, indent string, comments []string) {
+	for _, c := range comments {
+		switch {
+		case c == "":
+			b.WriteString("\n")
+		case strings.HasPrefix(c, "#"):
+			writeLine(b, "", strings.TrimRight(c, " \t"), "")
+		default:
+			writeLine(b, indent, strings.TrimRight(c, " \t"), "")
+		}
+	}
+}
+
+func formatValue(s *StatementAst) string {
+	v := s.Value
+	switch {
+	case v.Flags != nil:
+		var flags []string
+		for _, f := range v.Flags {
+			switch {
+			case f.Boot:
+				flags = append(flags, "BOOT")
+			case f.Object:
+				flags = append(flags, "OBJECT")
+			case f.Raw:
+				flags = append(flags, "RAW")
+			}
+		}
+		return strings.Join(flags, " ")
+	case v.MaxSegment != nil:
+		return fmt.Sprintf("max[%s, %s]", quote(v.MaxSegment.First), quote(v.MaxSegment.Second))
+	case v.MinSegment != nil:
+		return fmt.Sprintf("min[%s, %s]", quote(v.MinSegment.First), quote(v.MinSegment.Second))
+	case v.Expression != nil:
+		return formatExpression(v.Expression)
+	}
+	return quote(v.String)
+}
+
+// quote quotes s the way the spec lexer reads strings: verbatim.
+func quote(s string) string {
+	return `"` + s + `"`
+}
+
+func formatExpression(e *Expression) string {
+	out := formatUnary(e.Lhs)
+	for _, op := range e.Rest {
+		out += " " + op.Op + " " + formatUnary(op.Rhs)
+	}
+	return out
+}
+
+func formatUnary(u *UnaryExpr) string {
+	o := u.Operand
+	switch {
+	case o.Sub != nil:
+		return u.Op + "(" + formatExpression(o.Sub) + ")"
+	case o.Symbol != "":
+		return u.Op + o.Symbol
+	}
+	return u.Op + o.Int
+}
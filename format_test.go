@@ -0,0 +1,73 @@
+package spicy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormattingGoldenSpecs(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "fmt", "*.spec"))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, files)
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			src, err := ioutil.ReadFile(file)
+			assert.Nil(t, err)
+			got, err := FormatSpec(src, file)
+			if !assert.Nil(t, err) {
+				return
+			}
+			golden := strings.TrimSuffix(file, ".spec") + ".golden"
+			if *update {
+				assert.Nil(t, ioutil.WriteFile(golden, got, 0644))
+			}
+			want, err := ioutil.ReadFile(golden)
+			assert.Nil(t, err)
+			assert.Equal(t, string(want), string(got))
+		})
+	}
+}
+
+// Formatting formatted specs should change nothing.
+func TestFormattingIsIdempotent(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*", "*.spec"))
+	assert.Nil(t, err)
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		assert.Nil(t, err)
+		once, err := FormatSpec(src, file)
+		if !assert.Nil(t, err, file) {
+			continue
+		}
+		twice, err := FormatSpec(once, file)
+		assert.Nil(t, err, file)
+		assert.Equal(t, string(once), string(twice), file)
+	}
+}
+
+func TestFormattingKeepsStatementsInsideConditionals(t *testing.T) {
+	src := `beginseg
+	include "a.o"
+#ifdef FIXED
+	address 0x80100000
+#else
+	after "code"
+#endif
+	name "a"
+endseg
+`
+	got, err := FormatSpec([]byte(src), "a.spec")
+	assert.Nil(t, err)
+	assert.Equal(t, src, string(got))
+}
+
+func TestFormattingReportsParseErrors(t *testing.T) {
+	_, err := FormatSpec([]byte("beginseg\n\tadress 0x10\nendseg\n"), "a.spec")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "a.spec:2:2: Unknown statement 'adress' (did you mean 'address'?)\n\tadress 0x10\n\t^")
+	}
+}
@@ -3,17 +3,16 @@ module github.com/trhodeos/spicy
 go 1.19
 
 require (
-	github.com/alecthomas/participle v0.7.1
 	github.com/ogier/pflag v0.0.1
 	github.com/sirupsen/logrus v1.9.0
 	github.com/stretchr/testify v1.7.0
+	github.com/trhodeos/ecoff v0.0.1
 	github.com/trhodeos/n64rom v0.0.1
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/trhodeos/ecoff v0.0.1 // indirect
 	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
@@ -0,0 +1,75 @@
+package spicy
+
+import (
+	"io"
+	"text/template"
+)
+
+// segmentsHeaderData is what the segments header template is executed with.
+type segmentsHeaderData struct {
+	SpecFile       string
+	Waves          []*Wave
+	ObjectSegments []*Segment
+	RawSegments    []*Segment
+}
+
+var segmentsHeaderTemplate = template.Must(template.New("segments.h").Parse(
+	`/* Generated by spicy from {{.SpecFile}}. Do not edit. */
+#ifndef SPICY_SEGMENTS_H
+#define SPICY_SEGMENTS_H
+
+#ifndef _LANGUAGE_ASSEMBLY
+{{range .ObjectSegments}}
+/* {{.Name}} */
+extern unsigned char _{{.Name}}SegmentRomStart[], _{{.Name}}SegmentRomEnd[];
+extern unsigned char _{{.Name}}SegmentStart[], _{{.Name}}SegmentEnd[];
+extern unsigned char _{{.Name}}SegmentTextStart[], _{{.Name}}SegmentTextEnd[];
+extern unsigned char _{{.Name}}SegmentDataStart[], _{{.Name}}SegmentDataEnd[];
+extern unsigned char _{{.Name}}SegmentBssStart[], _{{.Name}}SegmentBssEnd[];
+extern unsigned char _{{.Name}}SegmentBssSize[];
+{{end}}{{range .RawSegments}}
+/* {{.Name}} (raw) */
+extern unsigned char _{{.Name}}SegmentRomStart[], _{{.Name}}SegmentRomEnd[];
+extern unsigned char _{{.Name}}SegmentDataStart[], _{{.Name}}SegmentDataEnd[];
+{{end}}{{range .Waves}}
+/* wave {{.Name}} */
+extern unsigned char _{{.Name}}WaveRomStart[], _{{.Name}}WaveRomEnd[];
+{{end}}
+/* The font, only defined when the rom is built with one. */
+extern unsigned char _FontRomStart[], _FontRomEnd[];
+
+/* Size in bytes of a segment in rom, and of its bss in memory. */
+#define SEGMENT_ROM_SIZE(name) \
+	((unsigned long)(_##name##SegmentRomEnd - _##name##SegmentRomStart))
+#define SEGMENT_BSS_SIZE(name) \
+	((unsigned long)(_##name##SegmentBssEnd - _##name##SegmentBssStart))
+
+#endif /* _LANGUAGE_ASSEMBLY */
+
+#endif /* SPICY_SEGMENTS_H */
+`))
+
+// WriteSegmentsHeader writes a C header declaring the symbols the linker
+// script defines for every segment and wave in the spec, and for the font, so
+// game code doesn't have to.
+// specFile is only used in the header's comment.
+func WriteSegmentsHeader(w io.Writer, spec *Spec, specFile string) error {
+	data := segmentsHeaderData{SpecFile: specFile, Waves: spec.Waves}
+	// A segment can be in several waves, but must only be declared once.
+	seen := map[string]bool{}
+	for _, wave := range spec.Waves {
+		for _, seg := range wave.ObjectSegments {
+			if !seen[seg.Name] {
+				seen[seg.Name] = true
+				data.ObjectSegments = append(data.ObjectSegments, seg)
+			}
+		}
+		for _, seg := range wave.RawSegments {
+			if !seen[seg.Name] {
+				seen[seg.Name] = true
+				data.RawSegments = append(data.RawSegments, seg)
+			}
+		}
+	}
+	return segmentsHeaderTemplate.Execute(w, data)
+}
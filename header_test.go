@@ -0,0 +1,107 @@
+package spicy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteSegmentsHeader(t *testing.T) {
+	assert := assert.New(t)
+	specStr := `
+beginseg
+	name "code"
+	flags BOOT OBJECT
+	entry boot
+	stack boot_stack
+	include "code.o"
+endseg
+beginseg
+	name "tex"
+	flags RAW
+	include "tex.bin"
+endseg
+beginwave
+	name "a"
+	include "code"
+	include "tex"
+endwave
+beginwave
+	name "b"
+	include "code"
+endwave
+`
+	spec, err := ParseSpec(strings.NewReader(specStr))
+	assert.Nil(err)
+	var b bytes.Buffer
+	assert.Nil(WriteSegmentsHeader(&b, spec, "game.spec"))
+	header := b.String()
+	assert.Contains(header, "/* Generated by spicy from game.spec. Do not edit. */")
+	assert.Contains(header, "extern unsigned char _codeSegmentRomStart[], _codeSegmentRomEnd[];")
+	assert.Contains(header, "extern unsigned char _codeSegmentBssStart[], _codeSegmentBssEnd[];")
+	assert.Contains(header, "extern unsigned char _texSegmentDataStart[], _texSegmentDataEnd[];")
+	assert.NotContains(header, "_texSegmentBssStart")
+	assert.Equal(1, strings.Count(header, "_codeSegmentTextStart[]"))
+	assert.Contains(header, "#define SEGMENT_ROM_SIZE(name)")
+	assert.Contains(header, "#define SEGMENT_BSS_SIZE(name)")
+}
+
+var ldScriptSymbolRegexp = regexp.MustCompile(`(?m)^\s*(_\w+) =`)
+
+func TestSegmentsHeaderDeclaresLinkerSymbols(t *testing.T) {
+	spec, err := ParseSpec(strings.NewReader(twoWaveSpec + `
+beginseg
+	name "tex"
+	flags RAW
+	include "tex.bin"
+endseg
+beginwave
+	name "third"
+	include "a"
+	include "tex"
+endwave
+`))
+	if !assert.Nil(t, err) {
+		return
+	}
+	var b bytes.Buffer
+	assert.Nil(t, WriteSegmentsHeader(&b, spec, "game.spec"))
+	header := b.String()
+
+	symbols := map[string]bool{}
+	for _, w := range spec.Waves {
+		rawObjects := map[string]string{}
+		for _, seg := range w.RawSegments {
+			for _, include := range seg.Includes {
+				rawObjects[include] = include + ".o"
+			}
+		}
+		script, err := createLdScript(w, "entry.o", rawObjects, nil)
+		if !assert.Nil(t, err) {
+			return
+		}
+		s, _ := ioutil.ReadAll(script)
+		for _, m := range ldScriptSymbolRegexp.FindAllStringSubmatch(string(s), -1) {
+			symbols[m[1]] = true
+		}
+		symbols[waveRomStartSymbol(w)] = true
+		symbols[waveRomEndSymbol(w)] = true
+	}
+	for _, sym := range FontSymbols(nil) {
+		symbols[sym.Name] = true
+	}
+	// Only used inside the linker script.
+	for _, internal := range []string{"_RomStart", "_RomSize", "_RomEnd"} {
+		delete(symbols, internal)
+	}
+
+	assert.Contains(t, symbols, "_aSegmentBssSize")
+	assert.Contains(t, symbols, "_texSegmentRomStart")
+	for sym := range symbols {
+		assert.Contains(t, header, " "+sym+"[]", "%s is not declared", sym)
+	}
+}
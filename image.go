@@ -0,0 +1,58 @@
+package spicy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Image is an in-memory ROM image that grows as it is written to. Any holes
+// left between writes hold the fill byte.
+type Image struct {
+	data []byte
+	fill byte
+}
+
+func NewImage(fill byte) *Image {
+	return &Image{fill: fill}
+}
+
+func (i *Image) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New(fmt.Sprintf("Invalid offset %d", off))
+	}
+	i.Pad(int(off) + len(p))
+	return copy(i.data[off:], p), nil
+}
+
+// Pad grows the image to at least size bytes using the fill byte.
+func (i *Image) Pad(size int) {
+	if len(i.data) < size {
+		i.data = append(i.data, bytes.Repeat([]byte{i.fill}, size-len(i.data))...)
+	}
+}
+
+// MbitsToBytes converts a rom size in megabits to bytes.
+func MbitsToBytes(mbits int) int {
+	return mbits * 1024 * 1024 / 8
+}
+
+// PadToMbits pads the image to exactly mbits megabits, which must be a power
+// of two. It returns the number of unused bytes left in the image.
+func (i *Image) PadToMbits(mbits int) (int, error) {
+	if mbits <= 0 || mbits&(mbits-1) != 0 {
+		return 0, errors.New(fmt.Sprintf("Rom size %d Mbits must be a power of two", mbits))
+	}
+	size := MbitsToBytes(mbits)
+	if len(i.data) > size {
+		return 0, errors.New(fmt.Sprintf("Rom contents (0x%x bytes) exceed the rom size of %d Mbits (0x%x bytes) by 0x%x bytes",
+			len(i.data), mbits, size, len(i.data)-size))
+	}
+	slack := size - len(i.data)
+	i.Pad(size)
+	return slack, nil
+}
+
+func (i *Image) Bytes() []byte {
+	return i.data
+}
@@ -0,0 +1,34 @@
+package spicy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestImageFillsHoles(t *testing.T) {
+	assert := assert.New(t)
+	image := NewImage(0xff)
+	image.WriteAt([]byte{1, 2}, 2)
+	image.WriteAt([]byte{3}, 0)
+	assert.Equal([]byte{3, 0xff, 1, 2}, image.Bytes())
+}
+
+func TestImagePadToMbits(t *testing.T) {
+	assert := assert.New(t)
+	image := NewImage(0xff)
+	image.WriteAt(make([]byte, 0x1000), 0)
+	slack, err := image.PadToMbits(8)
+	assert.Nil(err)
+	assert.Equal(0x100000-0x1000, slack)
+	assert.Equal(0x100000, len(image.Bytes()))
+	assert.Equal(byte(0xff), image.Bytes()[0x100000-1])
+
+	_, err = image.PadToMbits(12)
+	assert.NotNil(err)
+
+	image.WriteAt([]byte{0}, 0x100000)
+	_, err = image.PadToMbits(8)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "by 0x1 bytes")
+	}
+}
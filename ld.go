@@ -2,10 +2,11 @@ package spicy
 
 import (
 	"bytes"
-	"encoding/hex"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"math/rand"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"text/template"
@@ -15,26 +16,41 @@ import (
 
 var ldArgs = []string{"-G 0", "-nostartfiles", "-nodefaultlibs", "-nostdinc", "-M"}
 
-func createLdScript(w *Wave) (io.Reader, error) {
+// ldScriptData is what the linker script template is executed with.
+type ldScriptData struct {
+	*Wave
+	// Path of the object with the generated entry point.
+	EntryObject string
+	// Paths of the wrapped objects for each raw segment include.
+	RawObjects map[string]string
+	// Placeholder symbols, defined only if the wave refers to them.
+	Provided []Symbol
+}
+
+func createLdScript(w *Wave, entryObject string, rawObjects map[string]string, provided []Symbol) (io.Reader, error) {
 	t := `
 ENTRY(_start)
 MEMORY {
     ram (RX) : ORIGIN = 0x80000000, LENGTH = 0x7FFFFFFF
     ram.bss (RW) : ORIGIN = 0x80000000, LENGTH = 0x7FFFFFFF
 }
+{{range .Provided -}}
+PROVIDE({{.Name}} = {{printf "0x%x" .Value}});
+{{end -}}
 SECTIONS {
-    _RomStart = 0x1000;
+    _RomStart = DEFINED(_{{.Name}}WaveRomStart) ? _{{.Name}}WaveRomStart : 0x1000;
     _RomSize = _RomStart;
     ..generatedStartEntry 0x80000400 : AT(_RomSize)
     {
-      a.out (.text)
-      a.out (.bss)
-      a.out (.data)
+      "{{.EntryObject}}" (.text)
+      "{{.EntryObject}}" (.bss)
+      "{{.EntryObject}}" (.data)
     } > ram
     {{range .ObjectSegments -}}
       {{if (gt .Positioning.Address 0x80000400)}}
         _RomSize = ({{.Positioning.Address}} - 0x80000400) + _RomStart;
       {{end}}
+    _RomSize = ALIGN(_RomSize, {{printf "0x%x" .Alignment}});
     _{{.Name}}SegmentRomStart = _RomSize;
     ..{{.Name}}
     {{if ne .Positioning.AfterSegment ""}}
@@ -50,10 +66,10 @@ SECTIONS {
     {{else if not (eq .Positioning.Address 0)}}
       {{.Positioning.Address}}
     {{end}}
-    : AT(_RomSize)
+    : AT(_RomSize) ALIGN({{printf "0x%x" .Alignment}})
     {
       _{{.Name}}SegmentStart = .;
-      . = ALIGN(0x10);
+      . = ALIGN({{printf "0x%x" .Alignment}});
       _{{.Name}}SegmentTextStart = .;
       {{range .Includes -}}
         {{.}} (.text)
@@ -98,13 +114,14 @@ SECTIONS {
     _{{.Name}}SegmentBssSize =  _{{.Name}}SegmentBssEnd - _{{.Name}}SegmentBssStart;
   {{ end }}
   {{range .RawSegments -}}
+    _RomSize = ALIGN(_RomSize, {{printf "0x%x" .Alignment}});
     _{{.Name}}SegmentRomStart = _RomSize;
-    ..{{.Name}} : AT(_RomSize)
+    ..{{.Name}} : AT(_RomSize) ALIGN({{printf "0x%x" .Alignment}})
     {
-      . = ALIGN(0x10);
+      . = ALIGN({{printf "0x%x" .Alignment}});
       _{{.Name}}SegmentDataStart = .;
       {{range .Includes -}}
-      "{{.}}.o"
+      "{{index $.RawObjects .}}"
       {{end}}
       . = ALIGN(0x10);
       _{{.Name}}SegmentDataEnd = .;
@@ -126,43 +143,169 @@ SECTIONS {
 		return nil, err
 	}
 	b := &bytes.Buffer{}
-	err = tmpl.Execute(b, w)
+	err = tmpl.Execute(b, ldScriptData{Wave: w, EntryObject: entryObject, RawObjects: rawObjects, Provided: provided})
 	if err == nil {
 		log.Debugln("Ld script generated:\n", b.String())
 	}
 	return b, err
 }
 
-func LinkSpec(w *Wave, ld Runner, entry io.Reader) (io.Reader, error) {
+// Symbol is an absolute symbol defined on the linker command line.
+type Symbol struct {
+	Name  string
+	Value uint64
+	// Provide makes the symbol a placeholder, defined with PROVIDE in the
+	// linker script instead, so it is only in the output if the wave refers
+	// to it.
+	Provide bool
+}
+
+// defsyms returns the --defsym values defining symbols.
+func defsyms(symbols []Symbol) []string {
+	var out []string
+	for _, sym := range symbols {
+		out = append(out, fmt.Sprintf("%s=0x%x", sym.Name, sym.Value))
+	}
+	return out
+}
+
+func linkArgs(script string, output string, defsyms []string) []string {
+	args := append([]string{}, ldArgs...)
+	for _, d := range defsyms {
+		args = append(args, "--defsym", d)
+	}
+	return append(args, "-dT", script, "-o", output)
+}
+
+// entryObjectPath is where CreateEntryBinary and LinkSpec put the entry object
+// of a wave.
+func entryObjectPath(dir string, w *Wave) string {
+	return filepath.Join(dir, w.Name+".entry.o")
+}
+
+// rawObjectPaths returns where WrapRawSegments and LinkSpec put the wrapped
+// object of every raw segment include of a wave. An include in several raw
+// segments is only wrapped once, as the first of them.
+func rawObjectPaths(dir string, w *Wave) map[string]string {
+	out := map[string]string{}
+	for _, seg := range w.RawSegments {
+		for i, include := range seg.Includes {
+			if _, ok := out[include]; !ok {
+				out[include] = filepath.Join(dir, fmt.Sprintf("%s.%s.%d.o", w.Name, seg.Name, i))
+			}
+		}
+	}
+	return out
+}
+
+// binaryPath is where BinarizeObject puts the rom contents of a wave.
+func binaryPath(dir string, w *Wave) string {
+	return filepath.Join(dir, w.Name+".bin")
+}
+
+// LinkSpec links a wave, writing the files ld needs to the scratch directory
+// dir. entry is the object created by CreateEntryBinary and rawObjects holds
+// the wrapped object for every raw segment include, as created by
+// WrapRawSegments.
+func LinkSpec(ctx context.Context, dir string, w *Wave, ld Runner, entry io.Reader, rawObjects map[string]io.Reader, symbols ...Symbol) (io.Reader, error) {
 	name := w.Name
 	log.Infof("Linking spec \"%s\".", name)
-	ldscript, err := createLdScript(w)
+	// The objects get fixed names, so the linker script is the same every
+	// time the wave is linked.
+	entryPath := entryObjectPath(dir, w)
+	if err := writeFile(entryPath, entry); err != nil {
+		return nil, err
+	}
+	dependencies := []string{entryPath}
+	rawPaths := rawObjectPaths(dir, w)
+	written := map[string]bool{}
+	for _, seg := range w.RawSegments {
+		for _, include := range seg.Includes {
+			if written[include] {
+				continue
+			}
+			obj, ok := rawObjects[include]
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("No object for include %s of raw segment %s", include, seg.Name))
+			}
+			if err := writeFile(rawPaths[include], obj); err != nil {
+				return nil, err
+			}
+			written[include] = true
+			dependencies = append(dependencies, rawPaths[include])
+		}
+	}
+	for _, seg := range w.ObjectSegments {
+		dependencies = append(dependencies, seg.Includes...)
+	}
+	var defined, provided []Symbol
+	for _, sym := range symbols {
+		if sym.Provide {
+			provided = append(provided, sym)
+		} else {
+			defined = append(defined, sym)
+		}
+	}
+	ldscript, err := createLdScript(w, entryPath, rawPaths, provided)
 	if err != nil {
 		return nil, err
 	}
-	outputPath := fmt.Sprintf("%s.out", name)
+	outputPath := filepath.Join(dir, fmt.Sprintf("%s.out", name))
 	mappedInputs := map[string]io.Reader{
 		"ld-script": ldscript,
 	}
-	return NewMappedFileRunner(ld, mappedInputs, outputPath).Run( /* stdin=*/ nil, append(ldArgs, "-dT", "ld-script", "-o", outputPath))
-}
-func TempFileName(suffix string) string {
-	randBytes := make([]byte, 16)
-	rand.Read(randBytes)
-	return filepath.Join(os.TempDir(), hex.EncodeToString(randBytes)+suffix)
+	runner := NewMappedFileRunner(ld, mappedInputs, outputPath).InDir(dir).WithDependencies(dependencies...)
+	return runner.RunContext(ctx, nil /* stdin */, linkArgs("ld-script", outputPath, defsyms(defined)))
 }
 
-func BinarizeObject(obj io.Reader, objcopy Runner) (io.Reader, error) {
-	outputBin := TempFileName(".bin")
+// BinarizeObject extracts the rom contents of the linked object of a wave.
+func BinarizeObject(ctx context.Context, dir string, w *Wave, obj io.Reader, objcopy Runner) (io.Reader, error) {
+	outputBin := binaryPath(dir, w)
 	mappedInputs := map[string]io.Reader{
 		"objFile": obj,
 	}
-	return NewMappedFileRunner(objcopy, mappedInputs, outputBin).Run( /* stdin=*/ nil, []string{"-O", "binary", "objFile", outputBin})
+	return NewMappedFileRunner(objcopy, mappedInputs, outputBin).InDir(dir).RunContext(ctx, nil /* stdin */, binarizeArgs("objFile", outputBin))
+}
+
+func binarizeArgs(obj string, output string) []string {
+	return []string{"-O", "binary", obj, output}
+}
+
+// WrapRawSegments wraps every include of the wave's raw segments in a
+// relocatable object, keyed by include path.
+func WrapRawSegments(ctx context.Context, dir string, w *Wave, ld Runner) (map[string][]byte, error) {
+	out := map[string][]byte{}
+	paths := rawObjectPaths(dir, w)
+	for _, seg := range w.RawSegments {
+		for _, include := range seg.Includes {
+			if _, ok := out[include]; ok {
+				continue
+			}
+			f, err := os.Open(include)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not read include %s of raw segment %s: %s", include, seg.Name, err))
+			}
+			obj, err := CreateRawObjectWrapper(ctx, dir, f, paths[include], ld)
+			f.Close()
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not wrap include %s of raw segment %s: %s", include, seg.Name, err))
+			}
+			out[include], err = ioutil.ReadAll(obj)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return out, nil
 }
 
-func CreateRawObjectWrapper(r io.Reader, outputName string, ld Runner) (io.Reader, error) {
+func CreateRawObjectWrapper(ctx context.Context, dir string, r io.Reader, outputName string, ld Runner) (io.Reader, error) {
 	mappedInputs := map[string]io.Reader{
 		"input": r,
 	}
-	return NewMappedFileRunner(ld, mappedInputs, outputName).Run( /* stdin=*/ nil, []string{"-r", "-b", "binary", "-o", outputName, "input"})
+	return NewMappedFileRunner(ld, mappedInputs, outputName).InDir(dir).RunContext(ctx, nil /* stdin */, rawWrapperArgs("input", outputName))
+}
+
+func rawWrapperArgs(input string, output string) []string {
+	return []string{"-r", "-b", "binary", "-o", output, input}
 }
@@ -0,0 +1,112 @@
+package spicy
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLdScriptUsesSegmentAlignment(t *testing.T) {
+	assert := assert.New(t)
+	specStr := `
+beginseg
+  name "boot"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  include "boot.o"
+endseg
+beginseg
+  name "code"
+  flags OBJECT
+  include "code.o"
+  align 0x1000
+endseg
+beginseg
+  name "other"
+  flags OBJECT
+  include "other.o"
+  after "code"
+endseg
+beginwave
+  name "wave"
+  include "boot"
+  include "code"
+  include "other"
+endwave
+`
+	spec, err := ParseSpec(strings.NewReader(specStr))
+	assert.Nil(err)
+	r, err := createLdScript(spec.Waves[0], "entry.o", nil, nil)
+	assert.Nil(err)
+	script, err := ioutil.ReadAll(r)
+	assert.Nil(err)
+	assert.Contains(string(script), "_RomSize = ALIGN(_RomSize, 0x1000);\n    _codeSegmentRomStart = _RomSize;")
+	assert.Contains(string(script), ": AT(_RomSize) ALIGN(0x1000)")
+	assert.Contains(string(script), "_RomSize = ALIGN(_RomSize, 0x10);\n    _otherSegmentRomStart = _RomSize;")
+}
+
+// fakeLd records its arguments and writes an empty output file.
+type fakeLd struct {
+	args []string
+}
+
+func (f *fakeLd) Run(r io.Reader, args []string) (io.Reader, error) {
+	f.args = args
+	for i, arg := range args {
+		if arg == "-o" {
+			return nil, ioutil.WriteFile(args[i+1], nil, 0644)
+		}
+	}
+	return nil, nil
+}
+
+func TestLinkSpecDefinesSymbols(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	w := &Wave{Name: "wave"}
+	ld := &fakeLd{}
+	_, err := LinkSpec(context.Background(), dir, w, ld, strings.NewReader(""), nil, FontSymbols(make([]byte, 0x10))...)
+	assert.Nil(err)
+	args := strings.Join(ld.args, " ")
+	assert.Contains(args, "--defsym _FontRomStart=0xb70 --defsym _FontRomEnd=0xb80")
+	// Everything is kept in the scratch directory.
+	assert.Contains(args, "-dT "+filepath.Join(dir, "ld-script"))
+	assert.Contains(args, "-o "+filepath.Join(dir, "wave.out"))
+}
+
+func TestLinkSpecFeedsRawObjects(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	raw := &Segment{Name: "assets", Includes: []string{"assets.bin"}, Flags: Flags{Raw: true}}
+	w := &Wave{Name: "wave", RawSegments: []*Segment{raw}}
+
+	_, err := LinkSpec(context.Background(), dir, w, &fakeLd{}, strings.NewReader(""), nil)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "raw segment assets")
+	}
+
+	rawObjects := map[string]io.Reader{"assets.bin": strings.NewReader("object")}
+	_, err = LinkSpec(context.Background(), dir, w, &fakeLd{}, strings.NewReader(""), rawObjects)
+	assert.Nil(err)
+
+	script, err := createLdScript(w, "/tmp/entry.o", map[string]string{"assets.bin": "/tmp/assets.o"}, nil)
+	assert.Nil(err)
+	b, err := ioutil.ReadAll(script)
+	assert.Nil(err)
+	assert.Contains(string(b), `"/tmp/assets.o"`)
+	assert.Contains(string(b), `"/tmp/entry.o" (.text)`)
+}
+
+func TestWrapRawSegmentsReportsMissingFiles(t *testing.T) {
+	assert := assert.New(t)
+	raw := &Segment{Name: "assets", Includes: []string{filepath.Join(t.TempDir(), "missing.bin")}, Flags: Flags{Raw: true}}
+	_, err := WrapRawSegments(context.Background(), t.TempDir(), &Wave{RawSegments: []*Segment{raw}}, &fakeLd{})
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "of raw segment assets")
+	}
+}
@@ -0,0 +1,168 @@
+package spicy
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"text/tabwriter"
+)
+
+// LinkMap describes where everything in the linked waves ended up, like the
+// map makerom prints with -m.
+type LinkMap struct {
+	Waves []*WaveMap `json:"waves"`
+}
+
+type WaveMap struct {
+	Name     string        `json:"name"`
+	RomStart uint64        `json:"rom_start"`
+	RomEnd   uint64        `json:"rom_end"`
+	Segments []*SegmentMap `json:"segments"`
+}
+
+type SegmentMap struct {
+	Name string `json:"name"`
+	// The address the segment is linked to run at.
+	Vma      uint64      `json:"vma"`
+	RomStart uint64      `json:"rom_start"`
+	RomEnd   uint64      `json:"rom_end"`
+	TextSize uint64      `json:"text_size"`
+	DataSize uint64      `json:"data_size"`
+	BssSize  uint64      `json:"bss_size"`
+	Symbols  []MapSymbol `json:"symbols"`
+}
+
+type MapSymbol struct {
+	Name  string `json:"name"`
+	Value uint64 `json:"value"`
+}
+
+// The symbols the linker script defines for a segment besides those in
+// SegmentSymbols.
+var otherSegmentSymbolRegexp = regexp.MustCompile(`^_.+Segment(Start|End|BssSize)$`)
+
+// NewLinkMap builds the link map of the linked waves.
+func NewLinkMap(waves []*LinkedWave) (*LinkMap, error) {
+	out := &LinkMap{}
+	for _, l := range waves {
+		m, err := ReadWaveMap(l.Wave, bytes.NewReader(l.Object))
+		if err != nil {
+			return nil, &LinkError{Wave: l.Wave.Name, Err: err}
+		}
+		m.RomStart, m.RomEnd = l.RomStart, l.RomEnd
+		out.Waves = append(out.Waves, m)
+	}
+	return out, nil
+}
+
+// ReadWaveMap reads the map of a wave from its linked ELF file. The wave's
+// rom range is left for the caller to fill in.
+func ReadWaveMap(w *Wave, r io.ReaderAt) (*WaveMap, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	symbols, err := f.Symbols()
+	if err != nil {
+		return nil, err
+	}
+	var sections []string
+	for _, s := range f.Sections {
+		sections = append(sections, s.Name)
+	}
+	return waveMapFrom(w, symbols, sections), nil
+}
+
+// waveMapFrom builds a wave map from the symbols of its ELF file. sections
+// holds the section names by index.
+func waveMapFrom(w *Wave, symbols []elf.Symbol, sections []string) *WaveMap {
+	out := &WaveMap{Name: w.Name}
+	segmentSymbols := segmentSymbolsFrom(symbols)
+	bySection := map[string]*SegmentMap{}
+	for _, seg := range append(append([]*Segment{}, w.ObjectSegments...), w.RawSegments...) {
+		s := segmentSymbols[seg.Name]
+		if s == nil {
+			s = &SegmentSymbols{}
+		}
+		m := &SegmentMap{
+			Name:     seg.Name,
+			Vma:      s.TextStart,
+			RomStart: s.RomStart,
+			RomEnd:   s.RomEnd,
+			TextSize: s.TextEnd - s.TextStart,
+			DataSize: s.DataEnd - s.DataStart,
+			BssSize:  s.BssSize(),
+		}
+		// Raw segments only have data.
+		if seg.Flags.Raw {
+			m.Vma = s.DataStart
+		}
+		bySection[".."+seg.Name] = m
+		bySection[".."+seg.Name+".bss"] = m
+		out.Segments = append(out.Segments, m)
+	}
+
+	for _, sym := range symbols {
+		typ := elf.ST_TYPE(sym.Info)
+		if typ == elf.STT_SECTION || typ == elf.STT_FILE || sym.Name == "" {
+			continue
+		}
+		// The linker script's own symbols are already in the sizes.
+		if segmentSymbolRegexp.MatchString(sym.Name) || otherSegmentSymbolRegexp.MatchString(sym.Name) {
+			continue
+		}
+		if int(sym.Section) >= len(sections) {
+			continue
+		}
+		if m := bySection[sections[sym.Section]]; m != nil {
+			m.Symbols = append(m.Symbols, MapSymbol{Name: sym.Name, Value: sym.Value})
+		}
+	}
+	for _, m := range out.Segments {
+		sort.SliceStable(m.Symbols, func(i, j int) bool {
+			return m.Symbols[i].Value < m.Symbols[j].Value
+		})
+	}
+	sort.SliceStable(out.Segments, func(i, j int) bool {
+		return out.Segments[i].RomStart < out.Segments[j].RomStart
+	})
+	return out
+}
+
+// WriteText writes the map in a makerom-like text layout.
+func (m *LinkMap) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for i, wave := range m.Waves {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "Wave %s: rom 0x%08x - 0x%08x\n\n", wave.Name, wave.RomStart, wave.RomEnd)
+		fmt.Fprintln(tw, "Segment\tVMA\tRom start\tRom end\tText\tData\tBss\t")
+		for _, seg := range wave.Segments {
+			fmt.Fprintf(tw, "%s\t0x%08x\t0x%08x\t0x%08x\t0x%x\t0x%x\t0x%x\t\n",
+				seg.Name, seg.Vma, seg.RomStart, seg.RomEnd, seg.TextSize, seg.DataSize, seg.BssSize)
+		}
+		for _, seg := range wave.Segments {
+			if len(seg.Symbols) == 0 {
+				continue
+			}
+			fmt.Fprintf(tw, "\nSymbols in segment %s:\n", seg.Name)
+			for _, sym := range seg.Symbols {
+				fmt.Fprintf(tw, "  0x%08x\t%s\t\n", sym.Value, sym.Name)
+			}
+		}
+	}
+	return tw.Flush()
+}
+
+// WriteJSON writes the map as JSON.
+func (m *LinkMap) WriteJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(m)
+}
@@ -0,0 +1,59 @@
+package spicy
+
+import (
+	"bytes"
+	"debug/elf"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaveMapFrom(t *testing.T) {
+	assert := assert.New(t)
+	w := &Wave{
+		Name:           "wave",
+		ObjectSegments: []*Segment{{Name: "code"}},
+		RawSegments:    []*Segment{{Name: "tex", Flags: Flags{Raw: true}}},
+	}
+	sections := []string{"", "..generatedStartEntry", "..code", "..code.bss", "..tex"}
+	global := elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC)
+	symbols := []elf.Symbol{
+		{Name: "_codeSegmentRomStart", Value: 0x1050, Section: elf.SHN_ABS},
+		{Name: "_codeSegmentRomEnd", Value: 0x1250, Section: elf.SHN_ABS},
+		{Name: "_codeSegmentTextStart", Value: 0x80000450, Section: 2},
+		{Name: "_codeSegmentTextEnd", Value: 0x80000550, Section: 2},
+		{Name: "_codeSegmentDataStart", Value: 0x80000550, Section: 2},
+		{Name: "_codeSegmentDataEnd", Value: 0x80000650, Section: 2},
+		{Name: "_codeSegmentBssStart", Value: 0x80000650, Section: 3},
+		{Name: "_codeSegmentBssEnd", Value: 0x80000750, Section: 3},
+		{Name: "_codeSegmentStart", Value: 0x80000450, Section: 2},
+		{Name: "_texSegmentRomStart", Value: 0x1250, Section: elf.SHN_ABS},
+		{Name: "_texSegmentRomEnd", Value: 0x1260, Section: elf.SHN_ABS},
+		{Name: "_texSegmentDataStart", Value: 0x80000750, Section: 4},
+		{Name: "_texSegmentDataEnd", Value: 0x80000760, Section: 4},
+		{Name: "main", Info: global, Value: 0x80000500, Section: 2},
+		{Name: "boot", Info: global, Value: 0x80000450, Section: 2},
+		{Name: "buffer", Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT), Value: 0x80000650, Section: 3},
+		{Name: "_start", Info: global, Value: 0x80000400, Section: 1},
+		{Name: "code.c", Info: elf.ST_INFO(elf.STB_LOCAL, elf.STT_FILE), Section: elf.SHN_ABS},
+	}
+	m := waveMapFrom(w, symbols, sections)
+	assert.Equal([]*SegmentMap{
+		{
+			Name: "code", Vma: 0x80000450, RomStart: 0x1050, RomEnd: 0x1250,
+			TextSize: 0x100, DataSize: 0x100, BssSize: 0x100,
+			Symbols: []MapSymbol{{"boot", 0x80000450}, {"main", 0x80000500}, {"buffer", 0x80000650}},
+		},
+		{Name: "tex", Vma: 0x80000750, RomStart: 0x1250, RomEnd: 0x1260, DataSize: 0x10},
+	}, m.Segments)
+
+	var b bytes.Buffer
+	assert.Nil((&LinkMap{Waves: []*WaveMap{m}}).WriteText(&b))
+	assert.Contains(b.String(), "code     0x80000450  0x00001050  0x00001250  0x100  0x100  0x100")
+	assert.Contains(b.String(), "Symbols in segment code:\n  0x80000450  boot")
+
+	b.Reset()
+	assert.Nil((&LinkMap{Waves: []*WaveMap{m}}).WriteJSON(&b))
+	assert.Contains(b.String(), `"name": "tex"`)
+	assert.Contains(b.String(), `"vma": 2147485520`)
+}
@@ -0,0 +1,109 @@
+package spicy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	kseg0Start       = 0x80000000
+	kseg1End         = 0xC0000000
+	physicalAddrMask = 0x1FFFFFFF
+)
+
+// physicalRange returns the physical memory range backing a segment's
+// virtual range, and whether the segment is direct-mapped (KSEG0 or KSEG1)
+// at all.
+func physicalRange(start, end uint64) (uint64, uint64, bool) {
+	// Addresses may have been sign-extended by a 64-bit link.
+	start32, end32 := uint64(uint32(start)), uint64(uint32(end))
+	if start32 < kseg0Start || start32 >= kseg1End {
+		return 0, 0, false
+	}
+	phys := start32 & physicalAddrMask
+	return phys, phys + (end32 - start32), true
+}
+
+// Overlap is a pair of segments whose physical memory overlaps. Start and
+// End bound the overlapping physical range.
+type Overlap struct {
+	First  string
+	Second string
+	Start  uint64
+	End    uint64
+}
+
+// OverlapError reports every pair of overlapping segments in a wave.
+type OverlapError struct {
+	Wave     string
+	Overlaps []Overlap
+}
+
+func (e *OverlapError) Error() string {
+	lines := []string{fmt.Sprintf("Segments in wave %s overlap in physical memory:", e.Wave)}
+	for _, o := range e.Overlaps {
+		lines = append(lines, fmt.Sprintf("  %s and %s overlap at 0x%08x-0x%08x", o.First, o.Second, o.Start, o.End))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// isOverlayOf reports whether the two segments are overlays of one another,
+// i.e. they are placed at the same address or after the same segment(s).
+func (s *Segment) isOverlayOf(other *Segment) bool {
+	if s.Positioning == (Positioning{}) {
+		return false
+	}
+	return s.Positioning == other.Positioning
+}
+
+// CheckOverlaps verifies that no two direct-mapped object segments in the
+// linked wave share physical memory, unless they are overlays of one another.
+func CheckOverlaps(w *Wave, linked io.ReaderAt) error {
+	symbols, err := ReadSegmentSymbols(linked)
+	if err != nil {
+		return err
+	}
+	return checkOverlaps(w, symbols)
+}
+
+func checkOverlaps(w *Wave, symbols map[string]*SegmentSymbols) error {
+	type physical struct {
+		seg        *Segment
+		start, end uint64
+	}
+	var segs []physical
+	for _, seg := range w.ObjectSegments {
+		sym := symbols[seg.Name]
+		if sym == nil {
+			return errors.New(fmt.Sprintf("Could not find symbols for segment %s in linked output", seg.Name))
+		}
+		start, end, ok := physicalRange(sym.TextStart, sym.BssEnd)
+		if !ok || start == end {
+			continue
+		}
+		segs = append(segs, physical{seg, start, end})
+	}
+
+	out := &OverlapError{Wave: w.Name}
+	for i, a := range segs {
+		for _, b := range segs[i+1:] {
+			if a.start >= b.end || b.start >= a.end || a.seg.isOverlayOf(b.seg) {
+				continue
+			}
+			o := Overlap{First: a.seg.Name, Second: b.seg.Name, Start: a.start, End: a.end}
+			if b.start > o.Start {
+				o.Start = b.start
+			}
+			if b.end < o.End {
+				o.End = b.end
+			}
+			out.Overlaps = append(out.Overlaps, o)
+		}
+	}
+	if len(out.Overlaps) > 0 {
+		return out
+	}
+	return nil
+}
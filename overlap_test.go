@@ -0,0 +1,36 @@
+package spicy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCheckOverlaps(t *testing.T) {
+	assert := assert.New(t)
+	code := &Segment{Name: "code", Positioning: Positioning{Address: 0x80000400}}
+	uncached := &Segment{Name: "uncached", Positioning: Positioning{Address: 0xA0000800}}
+	overlayA := &Segment{Name: "overlayA", Positioning: Positioning{AfterSegment: "code"}}
+	overlayB := &Segment{Name: "overlayB", Positioning: Positioning{AfterSegment: "code"}}
+	mapped := &Segment{Name: "mapped", Positioning: Positioning{Address: 0x01000000}}
+	w := &Wave{Name: "wave", ObjectSegments: []*Segment{code, uncached, overlayA, overlayB, mapped}}
+	symbols := map[string]*SegmentSymbols{
+		"code":     {TextStart: 0x80000400, BssEnd: 0x80001000},
+		"uncached": {TextStart: 0xA0000800, BssEnd: 0xA0000900},
+		"overlayA": {TextStart: 0x80001000, BssEnd: 0x80002000},
+		"overlayB": {TextStart: 0x80001000, BssEnd: 0x80001800},
+		"mapped":   {TextStart: 0x01000000, BssEnd: 0x01100000},
+	}
+	err := checkOverlaps(w, symbols)
+	overlapErr, ok := err.(*OverlapError)
+	assert.True(ok)
+	assert.Equal([]Overlap{{First: "code", Second: "uncached", Start: 0x800, End: 0x900}}, overlapErr.Overlaps)
+
+	symbols["uncached"] = &SegmentSymbols{TextStart: 0xA0002000, BssEnd: 0xA0002100}
+	assert.Nil(checkOverlaps(w, symbols))
+
+	delete(symbols, "overlayB")
+	err = checkOverlaps(w, symbols)
+	if assert.NotNil(err) {
+		assert.Equal("Could not find symbols for segment overlayB in linked output", err.Error())
+	}
+}
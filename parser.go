@@ -0,0 +1,481 @@
+package spicy
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenType int
+
+const (
+	eofToken tokenType = iota
+	identToken
+	intToken
+	stringToken
+	punctToken
+	commentToken
+	// A line starting with '#', e.g. a cpp directive left in the spec.
+	directiveToken
+)
+
+func (t tokenType) String() string {
+	return [...]string{"end of file", "identifier", "integer", "string", "punctuation", "comment", "directive"}[t]
+}
+
+type token struct {
+	Type  tokenType
+	Value string
+	Pos   Position
+}
+
+func (t token) String() string {
+	if t.Type == eofToken {
+		return t.Type.String()
+	}
+	return fmt.Sprintf("%q", t.Value)
+}
+
+// Two character operators; every other punctuation token is one character.
+var longPuncts = []string{"<<", ">>"}
+
+// lexSpec splits spec text into tokens, including comments and directives.
+func lexSpec(text string, filename string) ([]token, error) {
+	var out []token
+	line, col := 1, 1
+	lineStart := true
+	advance := func(n int) {
+		for _, c := range text[:n] {
+			if c == '\n' {
+				line++
+				col = 1
+			} else {
+				col++
+			}
+		}
+		text = text[n:]
+	}
+	for {
+		for len(text) > 0 && strings.ContainsRune(" \t\r\n\f\v", rune(text[0])) {
+			if text[0] == '\n' {
+				lineStart = true
+			}
+			advance(1)
+		}
+		pos := Position{Filename: filename, Line: line, Column: col}
+		if len(text) == 0 {
+			return append(out, token{Type: eofToken, Pos: pos}), nil
+		}
+		c := text[0]
+		n := 0
+		typ := punctToken
+		switch {
+		case c == '#' && lineStart:
+			typ = directiveToken
+			n = strings.IndexByte(text, '\n')
+			// Directives continue onto the next line after a backslash.
+			for n > 0 && text[n-1] == '\\' {
+				next := strings.IndexByte(text[n+1:], '\n')
+				if next < 0 {
+					n = -1
+					break
+				}
+				n += next + 1
+			}
+			if n < 0 {
+				n = len(text)
+			}
+		case strings.HasPrefix(text, "//"):
+			typ = commentToken
+			n = strings.IndexByte(text, '\n')
+			if n < 0 {
+				n = len(text)
+			}
+		case strings.HasPrefix(text, "/*"):
+			typ = commentToken
+			n = strings.Index(text[2:], "*/")
+			if n < 0 {
+				return nil, newSpecError(pos, "Unterminated comment")
+			}
+			n += 4
+		case c == '"':
+			typ = stringToken
+			// Like makerom, strings have no escapes: everything up to the
+			// closing quote is taken as is, so Windows paths keep their
+			// backslashes.
+			for n = 1; n < len(text) && text[n] != '"' && text[n] != '\n'; n++ {
+			}
+			if n >= len(text) || text[n] != '"' {
+				return nil, newSpecError(pos, "Unterminated string")
+			}
+			n++
+		case isIdentStart(c):
+			typ = identToken
+			for n = 1; n < len(text) && isIdentChar(text[n]); n++ {
+			}
+		case c >= '0' && c <= '9':
+			typ = intToken
+			// Take everything that could be part of a number and let
+			// evaluation reject malformed ones.
+			for n = 1; n < len(text) && isIdentChar(text[n]); n++ {
+			}
+		default:
+			n = 1
+			for _, p := range longPuncts {
+				if strings.HasPrefix(text, p) {
+					n = len(p)
+				}
+			}
+		}
+		value := text[:n]
+		if typ == stringToken {
+			value = value[1 : n-1]
+		}
+		out = append(out, token{Type: typ, Value: value, Pos: pos})
+		lineStart = false
+		advance(n)
+	}
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+// Statements allowed in each kind of block, and the flags segments can have.
+var (
+	segmentKeywords = []string{"name", "address", "after", "include", "maxsize", "align", "flags", "number", "entry", "stack"}
+	waveKeywords    = []string{"name", "include"}
+	flagKeywords    = []string{"BOOT", "OBJECT", "RAW"}
+	blockKeywords   = []string{"beginseg", "beginwave"}
+)
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// suggest returns a " (did you mean ...?)" hint for word, if one of the
+// candidates is close to it.
+func suggest(word string, candidates []string) string {
+	best, bestDistance := "", 3
+	for _, c := range candidates {
+		d := editDistance(strings.ToLower(word), strings.ToLower(c))
+		if d < bestDistance {
+			best, bestDistance = c, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (did you mean '%s'?)", best)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// specParser is a recursive descent parser over the tokens of one spec.
+type specParser struct {
+	tokens []token
+	// The last token consumed by next.
+	last token
+	// Comments and directives skipped by peek, not yet attached to a node.
+	pending []token
+}
+
+// peek returns the next token other than a comment or directive, without
+// consuming it.
+func (p *specParser) peek() token {
+	for p.tokens[0].Type == commentToken || p.tokens[0].Type == directiveToken {
+		p.pending = append(p.pending, p.tokens[0])
+		p.tokens = p.tokens[1:]
+	}
+	return p.tokens[0]
+}
+
+func (p *specParser) next() token {
+	t := p.peek()
+	if t.Type != eofToken {
+		p.tokens = p.tokens[1:]
+	}
+	p.last = t
+	return t
+}
+
+// endLine is the line the token ends on.
+func endLine(t token) int {
+	return t.Pos.Line + strings.Count(t.Value, "\n")
+}
+
+// trailing takes a pending comment on the same line as the last token
+// consumed.
+func (p *specParser) trailing() string {
+	p.peek()
+	if len(p.pending) == 0 || p.pending[0].Type != commentToken || p.pending[0].Pos.Line != endLine(p.last) {
+		return ""
+	}
+	c := p.pending[0].Value
+	p.pending = p.pending[1:]
+	return c
+}
+
+// leading takes the pending comments before the next token, marking blank
+// lines between them with empty strings.
+func (p *specParser) leading() []string {
+	next := p.peek()
+	var out []string
+	for i, c := range p.pending {
+		out = append(out, c.Value)
+		following := next
+		if i+1 < len(p.pending) {
+			following = p.pending[i+1]
+		} else if next.Type == eofToken {
+			break
+		}
+		if following.Pos.Line > endLine(c)+1 {
+			out = append(out, "")
+		}
+	}
+	p.pending = nil
+	return out
+}
+
+func (p *specParser) isPunct(value string) bool {
+	t := p.peek()
+	return t.Type == punctToken && t.Value == value
+}
+
+func (p *specParser) expectPunct(value string) error {
+	if t := p.next(); t.Type != punctToken || t.Value != value {
+		return newSpecError(t.Pos, "Expected '%s', found %s", value, t)
+	}
+	return nil
+}
+
+func (p *specParser) expect(typ tokenType) (token, error) {
+	t := p.next()
+	if t.Type != typ {
+		return t, newSpecError(t.Pos, "Expected %s, found %s", typ, t)
+	}
+	return t, nil
+}
+
+func (p *specParser) parseSpec() (*SpecAst, error) {
+	out := &SpecAst{}
+	for {
+		leading := p.leading()
+		t := p.next()
+		switch {
+		case t.Type == eofToken:
+			out.End = Comments{Leading: leading}
+			return out, nil
+		case t.Type == identToken && t.Value == "beginseg":
+			seg := &SegmentAst{Pos: t.Pos, Comments: Comments{Leading: leading, Trailing: p.trailing()}}
+			var err error
+			seg.Statements, seg.End, err = p.parseStatements("endseg", segmentKeywords)
+			if err != nil {
+				return nil, err
+			}
+			out.Segments = append(out.Segments, seg)
+		case t.Type == identToken && t.Value == "beginwave":
+			wave := &WaveAst{Pos: t.Pos, Comments: Comments{Leading: leading, Trailing: p.trailing()}}
+			var err error
+			wave.Statements, wave.End, err = p.parseStatements("endwave", waveKeywords)
+			if err != nil {
+				return nil, err
+			}
+			out.Waves = append(out.Waves, wave)
+		default:
+			return nil, newSpecError(t.Pos, "Expected 'beginseg' or 'beginwave', found %s%s", t, suggest(t.Value, blockKeywords))
+		}
+	}
+}
+
+// parseStatements parses the statements of a block up to end, returning them
+// with the comments around end.
+func (p *specParser) parseStatements(end string, keywords []string) ([]*StatementAst, Comments, error) {
+	var out []*StatementAst
+	for {
+		leading := p.leading()
+		t := p.next()
+		if t.Type == identToken && t.Value == end {
+			return out, Comments{Leading: leading, Trailing: p.trailing()}, nil
+		}
+		if t.Type != identToken {
+			return nil, Comments{}, newSpecError(t.Pos, "Expected a statement or '%s', found %s", end, t)
+		}
+		if !contains(keywords, t.Value) {
+			return nil, Comments{}, newSpecError(t.Pos, "Unknown statement '%s'%s", t.Value, suggest(t.Value, append(keywords, end)))
+		}
+		statement := &StatementAst{Pos: t.Pos, Name: t.Value}
+		var err error
+		switch t.Value {
+		case "name", "include":
+			var s token
+			s, err = p.expect(stringToken)
+			statement.Value.String = s.Value
+		case "after":
+			err = p.parseAfter(&statement.Value)
+		case "flags":
+			statement.Value.Flags, err = p.parseFlags()
+		default:
+			statement.Value.Expression, err = p.parseExpression()
+		}
+		if err != nil {
+			return nil, Comments{}, err
+		}
+		statement.Comments = Comments{Leading: leading, Trailing: p.trailing()}
+		out = append(out, statement)
+	}
+}
+
+func (p *specParser) parseAfter(v *Value) error {
+	t := p.next()
+	if t.Type == stringToken {
+		v.String = t.Value
+		return nil
+	}
+	if t.Type != identToken || (t.Value != "max" && t.Value != "min") {
+		return newSpecError(t.Pos, "Expected a segment name, 'max[' or 'min[', found %s", t)
+	}
+	if err := p.expectPunct("["); err != nil {
+		return err
+	}
+	first, err := p.expect(stringToken)
+	if err != nil {
+		return err
+	}
+	if err := p.expectPunct(","); err != nil {
+		return err
+	}
+	second, err := p.expect(stringToken)
+	if err != nil {
+		return err
+	}
+	if err := p.expectPunct("]"); err != nil {
+		return err
+	}
+	if t.Value == "max" {
+		v.MaxSegment = &MaxSegment{First: first.Value, Second: second.Value}
+	} else {
+		v.MinSegment = &MinSegment{First: first.Value, Second: second.Value}
+	}
+	return nil
+}
+
+func (p *specParser) parseFlags() ([]*FlagAst, error) {
+	var out []*FlagAst
+	for {
+		t := p.peek()
+		// Flags run until the next statement.
+		if t.Type != identToken || (len(out) > 0 && (contains(segmentKeywords, t.Value) || t.Value == "endseg")) {
+			break
+		}
+		p.next()
+		switch t.Value {
+		case "BOOT":
+			out = append(out, &FlagAst{Boot: true})
+		case "OBJECT":
+			out = append(out, &FlagAst{Object: true})
+		case "RAW":
+			out = append(out, &FlagAst{Raw: true})
+		default:
+			return nil, newSpecError(t.Pos, "Unknown flag '%s'%s", t.Value, suggest(t.Value, flagKeywords))
+		}
+	}
+	if len(out) == 0 {
+		t := p.peek()
+		return nil, newSpecError(t.Pos, "Expected a flag, found %s", t)
+	}
+	return out, nil
+}
+
+func (p *specParser) parseExpression() (*Expression, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	out := &Expression{Lhs: lhs}
+	for {
+		t := p.peek()
+		if _, ok := precedence[t.Value]; t.Type != punctToken || !ok {
+			return out, nil
+		}
+		p.next()
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		out.Rest = append(out.Rest, &BinaryOp{Op: t.Value, Rhs: rhs})
+	}
+}
+
+func (p *specParser) parseUnary() (*UnaryExpr, error) {
+	out := &UnaryExpr{}
+	if p.isPunct("~") || p.isPunct("-") || p.isPunct("+") {
+		out.Op = p.next().Value
+	}
+	t := p.next()
+	switch {
+	case t.Type == intToken:
+		out.Operand = &Operand{Int: t.Value}
+	case t.Type == identToken:
+		out.Operand = &Operand{Symbol: t.Value}
+	case t.Type == punctToken && t.Value == "(":
+		sub, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return nil, err
+		}
+		out.Operand = &Operand{Sub: sub}
+	default:
+		return nil, newSpecError(t.Pos, "Expected a number, symbol or '(', found %s", t)
+	}
+	return out, nil
+}
+
+// parseSpecAst parses spec text (after preprocessing) into an ast.
+func parseSpecAst(text string, filename string) (*SpecAst, error) {
+	tokens, err := lexSpec(text, filename)
+	if err != nil {
+		return nil, err
+	}
+	p := &specParser{tokens: tokens}
+	return p.parseSpec()
+}
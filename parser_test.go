@@ -0,0 +1,122 @@
+package spicy
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// TestParsingGoldenSpecs parses each spec in testdata/specs and compares the
+// result with the matching .golden file. The specs are hand-written to cover
+// the spec syntax, not copied from real games.
+func TestParsingGoldenSpecs(t *testing.T) {
+	t.Setenv("ROOT", "/usr/ultra")
+	files, err := filepath.Glob(filepath.Join("testdata", "specs", "*.spec"))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, files)
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			f, err := os.Open(file)
+			assert.Nil(t, err)
+			defer f.Close()
+			spec, err := ParseNamedSpec(f, filepath.Base(file))
+			if !assert.Nil(t, err) {
+				return
+			}
+			got, err := json.MarshalIndent(spec, "", "\t")
+			assert.Nil(t, err)
+			golden := strings.TrimSuffix(file, ".spec") + ".golden"
+			if *update {
+				assert.Nil(t, ioutil.WriteFile(golden, append(got, '\n'), 0644))
+			}
+			want, err := ioutil.ReadFile(golden)
+			assert.Nil(t, err)
+			assert.Equal(t, string(want), string(got)+"\n")
+		})
+	}
+}
+
+func TestParsingSuggestsKeywords(t *testing.T) {
+	for _, test := range []struct {
+		spec string
+		msg  string
+	}{
+		{`beginseg adress 0x10 endseg`, "Unknown statement 'adress' (did you mean 'address'?)"},
+		{`beginseg name "a" flags OBJCT endseg`, "Unknown flag 'OBJCT' (did you mean 'OBJECT'?)"},
+		{`beginsge name "a" endseg`, "found \"beginsge\" (did you mean 'beginseg'?)"},
+		{`beginwave name "w" includ "a" endwave`, "Unknown statement 'includ' (did you mean 'include'?)"},
+		{`beginseg frobnicate 1 endseg`, "Unknown statement 'frobnicate'\n"},
+	} {
+		_, err := ParseSpec(strings.NewReader(test.spec))
+		if assert.NotNil(t, err, test.spec) {
+			assert.Contains(t, err.Error(), test.msg)
+		}
+	}
+}
+
+func TestParsingComments(t *testing.T) {
+	specStr := `
+/* a block comment
+   over lines */
+beginseg // trailing comment
+	name /* inline */ "code"
+	flags BOOT OBJECT
+	entry boot
+	stack bootStack
+	include "code.o"
+endseg
+beginwave
+	name "w"
+	include "code"
+endwave
+`
+	spec, err := ParseSpec(strings.NewReader(specStr))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "code", spec.Waves[0].ObjectSegments[0].Name)
+		assert.Equal(t, Position{Filename: stdinFilename, Line: 4, Column: 1}, spec.Waves[0].ObjectSegments[0].Pos)
+	}
+
+	_, err = ParseSpec(strings.NewReader("beginseg /* never closed\nendseg"))
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "<stdin>:1:10: Unterminated comment")
+	}
+}
+
+func TestParsingReadsStringsVerbatim(t *testing.T) {
+	specStr := `
+beginseg
+	name "code"
+	flags BOOT OBJECT
+	entry boot
+	stack bootStack
+	include "obj\code.o"
+	include "C:\ultra\usr\lib\PR\rspboot.o"
+endseg
+beginwave
+	name "w"
+	include "code"
+endwave
+`
+	spec, err := ParseSpec(strings.NewReader(specStr))
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{`obj\code.o`, `C:\ultra\usr\lib\PR\rspboot.o`}, spec.Waves[0].ObjectSegments[0].Includes)
+	}
+
+	formatted, err := FormatSpec([]byte(specStr), stdinFilename)
+	if assert.Nil(t, err) {
+		assert.Contains(t, string(formatted), `"obj\code.o"`)
+	}
+
+	_, err = ParseSpec(strings.NewReader("beginseg\n\tname \"code\n\"\nendseg"))
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "<stdin>:2:7: Unterminated string")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package spicy
+
+import (
+	"os/exec"
+)
+
+func startProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup only kills cmd itself, as there are no process groups.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
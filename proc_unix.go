@@ -0,0 +1,18 @@
+//go:build unix
+
+package spicy
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// startProcessGroup makes cmd start a new process group, so it can be killed
+// along with its children.
+func startProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
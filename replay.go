@@ -0,0 +1,170 @@
+package spicy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// recordedRun is a tool run saved by a RecordingRunner, stored as
+// <key>.json in the fixture directory.
+type recordedRun struct {
+	Tool string `json:"tool"`
+	// The arguments, with scratch paths made generic. Only there to make
+	// fixtures readable; the file name is what identifies the run.
+	Args []string `json:"args"`
+	// The output file of a MappedFileRunner run, or else stdout.
+	Output []byte `json:"output"`
+}
+
+func fixturePath(dir string, key string) string {
+	return filepath.Join(dir, key+".json")
+}
+
+// plainRun reads stdin of a run that isn't through a MappedFileRunner, such
+// as cpp's, and returns it with the run's key.
+func plainRun(tool string, r io.Reader, args []string) (*mappedRun, string, error) {
+	run, err := readMappedRun(MappedFileRunner{}, r, args)
+	if err != nil {
+		return nil, "", err
+	}
+	return run, run.key(tool), nil
+}
+
+// RecordingRunner runs a tool and saves every run in a fixture directory, so
+// a ReplayRunner can serve it back where the tool isn't installed.
+type RecordingRunner struct {
+	runner Runner
+	tool   string
+	dir    string
+}
+
+// NewRecordingRunner returns a runner recording the runs of r to dir. tool
+// names the tool, such as "ld", and must match the ReplayRunner's.
+func NewRecordingRunner(r Runner, tool string, dir string) *RecordingRunner {
+	return &RecordingRunner{runner: r, tool: tool, dir: dir}
+}
+
+func (c *RecordingRunner) Run(r io.Reader, args []string) (io.Reader, error) {
+	return c.RunContext(context.Background(), r, args)
+}
+
+func (c *RecordingRunner) RunContext(ctx context.Context, r io.Reader, args []string) (io.Reader, error) {
+	run, key, err := plainRun(c.tool, r, args)
+	if err != nil {
+		return nil, err
+	}
+	var stdin io.Reader
+	if run.stdin != nil {
+		stdin = bytes.NewReader(run.stdin)
+	}
+	result, err := RunContext(ctx, c.runner, stdin, args)
+	if err != nil {
+		return nil, err
+	}
+	out, err := ioutil.ReadAll(result)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.save(key, args, out); err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(out), nil
+}
+
+func (c *RecordingRunner) runMapped(ctx context.Context, m MappedFileRunner, r io.Reader, args []string) (io.Reader, error) {
+	run, err := readMappedRun(m, r, args)
+	if err != nil {
+		return nil, err
+	}
+	out, err := run.run(ctx, c.runner)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.save(run.key(c.tool), run.genericArgs(), out); err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(out), nil
+}
+
+func (c *RecordingRunner) save(key string, args []string, out []byte) error {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(&recordedRun{Tool: c.tool, Args: args, Output: out}, "", "  ")
+	if err != nil {
+		return err
+	}
+	log.Debugf("Recording %s %s as %s", c.tool, strings.Join(args, " "), key)
+	return ioutil.WriteFile(fixturePath(c.dir, key), append(b, '\n'), 0644)
+}
+
+// ReplayRunner serves the runs saved by a RecordingRunner instead of running
+// the tool. A run that wasn't recorded fails with a *ToolError.
+type ReplayRunner struct {
+	tool string
+	dir  string
+}
+
+// NewReplayRunner returns a runner replaying the runs of tool recorded in dir.
+func NewReplayRunner(tool string, dir string) *ReplayRunner {
+	return &ReplayRunner{tool: tool, dir: dir}
+}
+
+func (c *ReplayRunner) Run(r io.Reader, args []string) (io.Reader, error) {
+	return c.RunContext(context.Background(), r, args)
+}
+
+func (c *ReplayRunner) RunContext(ctx context.Context, r io.Reader, args []string) (io.Reader, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	_, key, err := plainRun(c.tool, r, args)
+	if err != nil {
+		return nil, err
+	}
+	out, err := c.load(key, args)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(out), nil
+}
+
+func (c *ReplayRunner) runMapped(ctx context.Context, m MappedFileRunner, r io.Reader, args []string) (io.Reader, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	run, err := readMappedRun(m, r, args)
+	if err != nil {
+		return nil, err
+	}
+	out, err := c.load(run.key(c.tool), args)
+	if err != nil {
+		return nil, err
+	}
+	return run.replay(out)
+}
+
+func (c *ReplayRunner) load(key string, args []string) ([]byte, error) {
+	b, err := ioutil.ReadFile(fixturePath(c.dir, key))
+	if os.IsNotExist(err) {
+		err = fmt.Errorf("no recorded run in %s (fixture %s); record it again", c.dir, key)
+	}
+	if err != nil {
+		return nil, &ToolError{Tool: c.tool, Args: args, Err: err}
+	}
+	var run recordedRun
+	if err := json.Unmarshal(b, &run); err != nil {
+		return nil, &ToolError{Tool: c.tool, Args: args, Err: err}
+	}
+	log.Debugf("Replaying %s %s from %s", c.tool, strings.Join(args, " "), key)
+	return run.Output, nil
+}
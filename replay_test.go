@@ -0,0 +1,168 @@
+package spicy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The committed fixtures were recorded with the LLVM stand-ins for the
+// mips64-elf toolchain in testdata/replay/tools:
+//
+//	PATH=$PWD/testdata/replay/tools:$PATH LLD=/path/to/ld.lld go test -record
+var record = flag.Bool("record", false, "record the replay test fixtures with the mips64-elf toolchain")
+
+const replayDir = "testdata/replay/simple"
+
+// replayOptions returns options for building the replay test program, with
+// runners serving the recorded fixtures, or recording them with -record.
+func replayOptions(t *testing.T) Options {
+	fixtures := filepath.Join(replayDir, "runs")
+	opts := Options{SpecFile: filepath.Join(replayDir, "simple.spec")}
+	tools := []struct {
+		runner  *Runner
+		tool    string
+		command string
+	}{
+		{&opts.Cpp, "cpp", "mips64-elf-gcc"},
+		{&opts.As, "as", "mips64-elf-as"},
+		{&opts.Ld, "ld", "mips64-elf-ld"},
+		{&opts.Objcopy, "objcopy", "mips64-elf-objcopy"},
+	}
+	if *record {
+		// code.o is an input of the program, not a recorded run.
+		cmd := exec.Command("mips64-elf-as", append(append([]string{}, compileArgs...),
+			"-o", filepath.Join(replayDir, "code.o"), filepath.Join(replayDir, "code.s"))...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("Could not assemble code.s: %s\n%s", err, out)
+		}
+		for _, tool := range tools {
+			*tool.runner = NewRecordingRunner(NewRunner(tool.command), tool.tool, fixtures)
+		}
+		return opts
+	}
+	if _, err := os.Stat(fixtures); err != nil {
+		t.Fatalf("No fixtures in %s; record them with go test -record: %s", fixtures, err)
+	}
+	for _, tool := range tools {
+		*tool.runner = NewReplayRunner(tool.tool, fixtures)
+	}
+	return opts
+}
+
+func TestRecordAndReplayRuns(t *testing.T) {
+	for _, tool := range []string{"cat", "cp"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
+	}
+	assert := assert.New(t)
+	fixtures := t.TempDir()
+	run := func(cat Runner, cp Runner) (string, string) {
+		out, err := cat.Run(strings.NewReader("stdin"), []string{"-"})
+		assert.NoError(err)
+		stdout, _ := ioutil.ReadAll(out)
+		// Each build has its own scratch directory, which mustn't matter.
+		dir := t.TempDir()
+		output := filepath.Join(dir, "out")
+		out, err = NewMappedFileRunner(cp, map[string]io.Reader{"in": strings.NewReader("file")}, output).InDir(dir).Run(nil, []string{"in", output})
+		assert.NoError(err)
+		copied, _ := ioutil.ReadAll(out)
+		onDisk, err := ioutil.ReadFile(output)
+		assert.NoError(err)
+		assert.Equal(copied, onDisk)
+		return string(stdout), string(copied)
+	}
+
+	stdout, copied := run(NewRecordingRunner(NewRunner("cat"), "cat", fixtures), NewRecordingRunner(NewRunner("cp"), "cp", fixtures))
+	assert.Equal("stdin", stdout)
+	assert.Equal("file", copied)
+	stdout, copied = run(NewReplayRunner("cat", fixtures), NewReplayRunner("cp", fixtures))
+	assert.Equal("stdin", stdout)
+	assert.Equal("file", copied)
+}
+
+func TestReplayFailsForUnrecordedRuns(t *testing.T) {
+	_, err := NewReplayRunner("cat", t.TempDir()).Run(strings.NewReader("stdin"), []string{"-"})
+	var toolErr *ToolError
+	if assert.True(t, errors.As(err, &toolErr)) {
+		assert.Equal(t, "cat", toolErr.Tool)
+		assert.Contains(t, err.Error(), "no recorded run")
+	}
+}
+
+func replayWave(t *testing.T, opts Options) *Wave {
+	spec, err := LoadSpec(context.Background(), opts)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return spec.Waves[0]
+}
+
+func TestReplayCreateEntryBinary(t *testing.T) {
+	opts := replayOptions(t)
+	w := replayWave(t, opts)
+	out, err := CreateEntryBinary(context.Background(), t.TempDir(), w, opts.As)
+	if !assert.NoError(t, err) {
+		return
+	}
+	b, err := ioutil.ReadAll(out)
+	assert.NoError(t, err)
+	f, err := elf.NewFile(bytes.NewReader(b))
+	if assert.NoError(t, err) {
+		assert.Equal(t, elf.EM_MIPS, f.Machine)
+		assert.Equal(t, elf.ET_REL, f.Type)
+	}
+}
+
+func TestReplayLinkSpec(t *testing.T) {
+	opts := replayOptions(t)
+	w := replayWave(t, opts)
+	dir := t.TempDir()
+	entry, err := CreateEntryBinary(context.Background(), dir, w, opts.As)
+	if !assert.NoError(t, err) {
+		return
+	}
+	linked, err := LinkSpec(context.Background(), dir, w, opts.Ld, entry, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	b, err := ioutil.ReadAll(linked)
+	assert.NoError(t, err)
+	symbols, err := ReadSegmentSymbols(bytes.NewReader(b))
+	if assert.NoError(t, err) && assert.Contains(t, symbols, "code") {
+		code := symbols["code"]
+		assert.Equal(t, uint64(0x1050), code.RomStart)
+		assert.Equal(t, uint64(0x2000), code.BssSize())
+	}
+}
+
+func TestReplayBuild(t *testing.T) {
+	opts := replayOptions(t)
+	result, err := Build(context.Background(), opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	sum := sha256.Sum256(result.Rom)
+	golden := filepath.Join(replayDir, "rom.sha256")
+	if *record {
+		assert.NoError(t, ioutil.WriteFile(golden, []byte(hex.EncodeToString(sum[:])+"\n"), 0644))
+	}
+	want, err := ioutil.ReadFile(golden)
+	if assert.NoError(t, err) {
+		assert.Equal(t, strings.TrimSpace(string(want)), hex.EncodeToString(sum[:]))
+	}
+}
@@ -0,0 +1,75 @@
+package spicy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+
+	"github.com/trhodeos/n64rom"
+)
+
+// makerom only uses the first half of the header; the rest (title, game code,
+// region and version) is optional.
+const minRomHeaderSize = 0x20
+
+// ParseRomHeader parses a makerom-style ASCII rom header file. Each pair of
+// hex digits is one byte of the header, in order. Whitespace is ignored and
+// '#', ';' and '//' start comments that run to the end of the line.
+func ParseRomHeader(r io.Reader, filename string) (n64rom.Header, error) {
+	var data []byte
+	var nibble byte
+	var pending bool
+	var last Position
+	var lastText string
+	lineNum := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNum++
+		text := scanner.Text()
+		content := text
+		for _, comment := range []string{"#", ";", "//"} {
+			if i := strings.Index(content, comment); i >= 0 {
+				content = content[:i]
+			}
+		}
+		for i, c := range content {
+			pos := Position{Filename: filename, Line: lineNum, Column: i + 1}
+			var v byte
+			switch {
+			case c == ' ' || c == '\t' || c == '\r':
+				continue
+			case c >= '0' && c <= '9':
+				v = byte(c - '0')
+			case c >= 'a' && c <= 'f':
+				v = byte(c-'a') + 10
+			case c >= 'A' && c <= 'F':
+				v = byte(c-'A') + 10
+			default:
+				return n64rom.Header{}, &SpecError{Pos: pos, Msg: "Invalid hex digit " + strings.TrimSpace(string(c)), Excerpt: text}
+			}
+			if len(data) == headerSize {
+				return n64rom.Header{}, &SpecError{Pos: pos, Msg: "Rom header is longer than 64 bytes", Excerpt: text}
+			}
+			if pending {
+				data = append(data, nibble<<4|v)
+			} else {
+				nibble = v
+			}
+			pending = !pending
+			last, lastText = pos, text
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return n64rom.Header{}, err
+	}
+	if pending {
+		return n64rom.Header{}, &SpecError{Pos: last, Msg: "Rom header has an odd number of hex digits", Excerpt: lastText}
+	}
+	if len(data) < minRomHeaderSize {
+		return n64rom.Header{}, newSpecError(Position{Filename: filename, Line: lineNum}, "Rom header must be at least %d bytes, found %d", minRomHeaderSize, len(data))
+	}
+	data = append(data, make([]byte, headerSize-len(data))...)
+	return n64rom.ParseHeader(bytes.NewReader(data), binary.BigEndian)
+}
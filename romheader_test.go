@@ -0,0 +1,52 @@
+package spicy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestParseRomHeader(t *testing.T) {
+	assert := assert.New(t)
+	headerStr := `# PI settings
+80371240
+0000000F  ; clock rate
+80000400  // boot address
+0000144c
+00000000 00000000
+00000000 00000000
+`
+	header, err := ParseRomHeader(strings.NewReader(headerStr), "romheader")
+	assert.Nil(err)
+	assert.Equal(uint8(0x80), header.X1)
+	assert.Equal(uint8(0x40), header.X4)
+	assert.Equal(uint32(0xF), header.ClockRate)
+	assert.Equal(uint32(0x80000400), header.BootAddress)
+	assert.Equal(uint32(0x144c), header.Release)
+
+	headerStr += `
+53504943 59000000 00000000 00000000 00000000
+00000000 0000004E 53504500
+`
+	header, err = ParseRomHeader(strings.NewReader(headerStr), "romheader")
+	assert.Nil(err)
+	assert.Equal("SPICY", strings.TrimRight(string(header.Name[:]), "\x00"))
+	assert.Equal(uint16(0x5350), header.CartId)
+	assert.Equal(uint8(0x45), header.CountryCode)
+}
+
+func TestParseRomHeaderErrors(t *testing.T) {
+	assert := assert.New(t)
+	_, err := ParseRomHeader(strings.NewReader("80371240\n0000000G\n"), "romheader")
+	if assert.NotNil(err) {
+		assert.True(strings.HasPrefix(err.Error(), "romheader:2:8: Invalid hex digit G"))
+	}
+	_, err = ParseRomHeader(strings.NewReader("80371240\n"), "romheader")
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "at least 32 bytes, found 4")
+	}
+	_, err = ParseRomHeader(strings.NewReader(strings.Repeat("00", 65)), "romheader")
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "longer than 64 bytes")
+	}
+}
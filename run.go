@@ -2,30 +2,72 @@ package spicy
 
 import (
 	"bytes"
-	"errors"
+	"context"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"io/ioutil"
-	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type Runner interface {
 	Run(r io.Reader, args []string) (io.Reader, error)
 }
 
+// ContextRunner is a Runner that stops when its context is done.
+type ContextRunner interface {
+	Runner
+	RunContext(ctx context.Context, r io.Reader, args []string) (io.Reader, error)
+}
+
+// RunContext runs runner with ctx if it is a ContextRunner. Other runners
+// can't be stopped once started, so ctx is only checked before running them.
+func RunContext(ctx context.Context, runner Runner, r io.Reader, args []string) (io.Reader, error) {
+	if c, ok := runner.(ContextRunner); ok {
+		return c.RunContext(ctx, r, args)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return runner.Run(r, args)
+}
+
 type ExecRunner struct {
 	command string
+	timeout time.Duration
 }
 
 func NewRunner(cmd string) ExecRunner {
 	return ExecRunner{command: cmd}
 }
 
+// WithTimeout returns a copy of the runner that kills the command if it runs
+// for longer than timeout. Zero means no timeout.
+func (e ExecRunner) WithTimeout(timeout time.Duration) ExecRunner {
+	e.timeout = timeout
+	return e
+}
+
+// Command returns the command the runner runs.
+func (e ExecRunner) Command() string {
+	return e.command
+}
+
 func (e ExecRunner) Run(r io.Reader, args []string) (io.Reader, error) {
+	return e.RunContext(context.Background(), r, args)
+}
+
+// RunContext runs the command, killing it along with any children it started
+// if ctx is done or the timeout passes first.
+func (e ExecRunner) RunContext(ctx context.Context, r io.Reader, args []string) (io.Reader, error) {
+	if e.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
+	}
 	log.Infof("About to run %s %s\n", e.command, strings.Join(args, " "))
 	cmd := exec.Command(e.command, args...)
 	var out bytes.Buffer
@@ -33,43 +75,83 @@ func (e ExecRunner) Run(r io.Reader, args []string) (io.Reader, error) {
 	cmd.Stdin = r
 	cmd.Stdout = &out
 	cmd.Stderr = &errout
-	err := cmd.Run()
+	// Compiler drivers like gcc run other programs, which must be killed too.
+	startProcessGroup(cmd)
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				killProcessGroup(cmd)
+			case <-done:
+			}
+		}()
+		err = cmd.Wait()
+		close(done)
+	}
 	log.Debug("stdout: ", out.String())
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		if ctxErr == context.DeadlineExceeded && e.timeout > 0 {
+			err = fmt.Errorf("timed out after %s: %w", e.timeout, ctxErr)
+		} else {
+			err = ctxErr
+		}
+		// Whatever it printed before being killed isn't the reason it failed.
+		errout.Reset()
+	}
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("Error running '%s': %s", e.command, errout.String()))
+		return nil, &ToolError{Tool: e.command, Args: args, Stderr: errout.String(), Err: err}
 	}
 	return &out, nil
 }
 
-type OutputFileRunner struct {
-	runner             Runner
-	expectedOutputFile string
-}
-
-func NewOutputFileRunner(r Runner, outputFile string) OutputFileRunner {
-	return OutputFileRunner{runner: r, expectedOutputFile: outputFile}
-}
-
-func (e OutputFileRunner) Run(r io.Reader, args []string) (io.Reader, error) {
-	_, err := e.runner.Run(r, args)
-	if err != nil {
-		return nil, err
-	}
-	return os.Open(e.expectedOutputFile)
+// mappedRunner is a Runner that handles MappedFileRunner runs itself, before
+// the input files are written, such as to cache them.
+type mappedRunner interface {
+	runMapped(ctx context.Context, m MappedFileRunner, r io.Reader, args []string) (io.Reader, error)
 }
 
 type MappedFileRunner struct {
 	runner        Runner
 	inputFileArgs map[string]io.Reader
 	outputFileArg string
+	// Where the input files are written; the system temp directory if empty.
+	dir string
+	// Files the tool reads that aren't in its arguments, such as the objects
+	// named in a linker script.
+	dependencies []string
 }
 
 func NewMappedFileRunner(r Runner, inputFileArgs map[string]io.Reader, outputFileArg string) MappedFileRunner {
 	return MappedFileRunner{runner: r, inputFileArgs: inputFileArgs, outputFileArg: outputFileArg}
 }
 
-func writeTempFile(r io.Reader, prefix string) (string, error) {
-	tmpfile, err := ioutil.TempFile("", prefix)
+// InDir returns a copy of the runner that writes its input files to dir.
+func (e MappedFileRunner) InDir(dir string) MappedFileRunner {
+	e.dir = dir
+	return e
+}
+
+// WithDependencies returns a copy of the runner that also depends on the given
+// files, which matters when its runs are cached.
+func (e MappedFileRunner) WithDependencies(paths ...string) MappedFileRunner {
+	e.dependencies = append(append([]string{}, e.dependencies...), paths...)
+	return e
+}
+
+func writeFile(path string, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// writeTempFile writes r to a new file in dir, or the system temp directory
+// if dir is empty, and returns its absolute path.
+func writeTempFile(r io.Reader, dir string, prefix string) (string, error) {
+	tmpfile, err := ioutil.TempFile(dir, prefix)
 	if err != nil {
 		return "", err
 	}
@@ -89,10 +171,17 @@ func writeTempFile(r io.Reader, prefix string) (string, error) {
 }
 
 func (e MappedFileRunner) Run(r io.Reader, args []string) (io.Reader, error) {
+	return e.RunContext(context.Background(), r, args)
+}
+
+func (e MappedFileRunner) RunContext(ctx context.Context, r io.Reader, args []string) (io.Reader, error) {
+	if c, ok := e.runner.(mappedRunner); ok {
+		return c.runMapped(ctx, e, r, args)
+	}
 	var newArgs []string = make([]string, len(args))
 	for i, arg := range args {
 		if _, ok := e.inputFileArgs[arg]; ok {
-			tempFile, err := writeTempFile(e.inputFileArgs[arg], arg)
+			tempFile, err := writeTempFile(e.inputFileArgs[arg], e.dir, arg)
 			if err != nil {
 				return nil, err
 			}
@@ -101,7 +190,7 @@ func (e MappedFileRunner) Run(r io.Reader, args []string) (io.Reader, error) {
 			newArgs[i] = args[i]
 		}
 	}
-	_, err := e.runner.Run(r, newArgs)
+	_, err := RunContext(ctx, e.runner, r, newArgs)
 	if err != nil {
 		return nil, err
 	}
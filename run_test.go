@@ -0,0 +1,47 @@
+package spicy
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecRunnerTimesOut(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	// The shell's child keeps stdout open, so this only returns early if
+	// the whole process group is killed.
+	start := time.Now()
+	_, err := NewRunner("sh").WithTimeout(100*time.Millisecond).Run(nil, []string{"-c", "sleep 10 & sleep 10"})
+	assert.Less(t, time.Since(start), 5*time.Second)
+	var toolErr *ToolError
+	if assert.True(t, errors.As(err, &toolErr)) {
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+		assert.Contains(t, err.Error(), "timed out after 100ms")
+	}
+}
+
+func TestExecRunnerStopsOnCancel(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := RunContext(ctx, NewMappedFileRunner(NewRunner("sh"), nil, "unused"), strings.NewReader(""), []string{"-c", "sleep 10"})
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestRunContextChecksPlainRunners(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := RunContext(ctx, catRunner{}, strings.NewReader("x"), nil)
+	assert.Equal(t, context.Canceled, err)
+}
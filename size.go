@@ -0,0 +1,64 @@
+package spicy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MaxSizeError reports every segment of a wave that outgrew its maxsize.
+type MaxSizeError struct {
+	Wave     string
+	Segments []SegmentOverflow
+}
+
+// SegmentOverflow describes a single segment that outgrew its maxsize. Size
+// counts both the segment's ROM contents and its bss.
+type SegmentOverflow struct {
+	Segment string
+	Size    uint64
+	MaxSize uint64
+}
+
+func (e *MaxSizeError) Error() string {
+	lines := []string{fmt.Sprintf("Segments in wave %s exceed their maxsize:", e.Wave)}
+	for _, s := range e.Segments {
+		lines = append(lines, fmt.Sprintf("  %s: size 0x%x, maxsize 0x%x, over by 0x%x bytes",
+			s.Segment, s.Size, s.MaxSize, s.Size-s.MaxSize))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// CheckMaxSizes verifies that no segment in the linked wave is larger than
+// its maxsize, as makerom does.
+func CheckMaxSizes(w *Wave, linked io.ReaderAt) error {
+	symbols, err := ReadSegmentSymbols(linked)
+	if err != nil {
+		return err
+	}
+	return checkMaxSizes(w, symbols)
+}
+
+func checkMaxSizes(w *Wave, symbols map[string]*SegmentSymbols) error {
+	out := &MaxSizeError{Wave: w.Name}
+	for _, segs := range [][]*Segment{w.ObjectSegments, w.RawSegments} {
+		for _, seg := range segs {
+			if seg.MaxSize == 0 {
+				continue
+			}
+			sym := symbols[seg.Name]
+			if sym == nil {
+				return errors.New(fmt.Sprintf("Could not find symbols for segment %s in linked output", seg.Name))
+			}
+			size := sym.RomSize() + sym.BssSize()
+			if size > seg.MaxSize {
+				out.Segments = append(out.Segments, SegmentOverflow{Segment: seg.Name, Size: size, MaxSize: seg.MaxSize})
+			}
+		}
+	}
+	if len(out.Segments) > 0 {
+		return out
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package spicy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCheckMaxSizes(t *testing.T) {
+	assert := assert.New(t)
+	w := &Wave{
+		Name: "wave",
+		ObjectSegments: []*Segment{
+			{Name: "fits", MaxSize: 0x200},
+			{Name: "big", MaxSize: 0x100},
+			{Name: "unlimited"},
+		},
+	}
+	symbols := map[string]*SegmentSymbols{
+		"fits":      {RomStart: 0x1000, RomEnd: 0x1100, BssStart: 0x80001000, BssEnd: 0x80001100},
+		"big":       {RomStart: 0x1100, RomEnd: 0x1200, BssStart: 0x80002000, BssEnd: 0x80002010},
+		"unlimited": {RomStart: 0x1200, RomEnd: 0x9000},
+	}
+	err := checkMaxSizes(w, symbols)
+	sizeErr, ok := err.(*MaxSizeError)
+	assert.True(ok)
+	assert.Equal([]SegmentOverflow{{Segment: "big", Size: 0x110, MaxSize: 0x100}}, sizeErr.Segments)
+	assert.Contains(err.Error(), "big: size 0x110, maxsize 0x100, over by 0x10 bytes")
+
+	symbols["big"].BssEnd = symbols["big"].BssStart
+	assert.Nil(checkMaxSizes(w, symbols))
+}
@@ -0,0 +1,140 @@
+package spicy
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// SegmentSizeDelta compares one segment between two builds. A segment missing
+// from a build has nil symbols there.
+type SegmentSizeDelta struct {
+	Segment string
+	Old     *SegmentSymbols
+	New     *SegmentSymbols
+}
+
+func textSize(s *SegmentSymbols) int64 {
+	if s == nil {
+		return 0
+	}
+	return int64(s.TextEnd - s.TextStart)
+}
+
+func dataSize(s *SegmentSymbols) int64 {
+	if s == nil {
+		return 0
+	}
+	return int64(s.DataEnd - s.DataStart)
+}
+
+func bssSize(s *SegmentSymbols) int64 {
+	if s == nil {
+		return 0
+	}
+	return int64(s.BssSize())
+}
+
+func romSize(s *SegmentSymbols) int64 {
+	if s == nil {
+		return 0
+	}
+	return int64(s.RomSize())
+}
+
+func (d *SegmentSizeDelta) Text() int64 { return textSize(d.New) - textSize(d.Old) }
+func (d *SegmentSizeDelta) Data() int64 { return dataSize(d.New) - dataSize(d.Old) }
+func (d *SegmentSizeDelta) Bss() int64  { return bssSize(d.New) - bssSize(d.Old) }
+func (d *SegmentSizeDelta) Rom() int64  { return romSize(d.New) - romSize(d.Old) }
+
+// SizeDiff compares the segment sizes of two linked waves.
+type SizeDiff struct {
+	Segments []*SegmentSizeDelta
+}
+
+// DiffSizes compares the segment sizes of two linked ELF files using the
+// symbols the linker script defines for each segment.
+func DiffSizes(before io.ReaderAt, after io.ReaderAt) (*SizeDiff, error) {
+	oldSymbols, err := ReadSegmentSymbols(before)
+	if err != nil {
+		return nil, err
+	}
+	newSymbols, err := ReadSegmentSymbols(after)
+	if err != nil {
+		return nil, err
+	}
+	return diffSizes(oldSymbols, newSymbols), nil
+}
+
+func diffSizes(before map[string]*SegmentSymbols, after map[string]*SegmentSymbols) *SizeDiff {
+	out := &SizeDiff{}
+	for name, s := range before {
+		out.Segments = append(out.Segments, &SegmentSizeDelta{Segment: name, Old: s, New: after[name]})
+	}
+	for name, s := range after {
+		if before[name] == nil {
+			out.Segments = append(out.Segments, &SegmentSizeDelta{Segment: name, New: s})
+		}
+	}
+	sort.Slice(out.Segments, func(i, j int) bool {
+		return out.Segments[i].Segment < out.Segments[j].Segment
+	})
+	return out
+}
+
+// RomSizes returns the total rom size of all segments in the old and new
+// builds.
+func (d *SizeDiff) RomSizes() (int64, int64) {
+	var before, after int64
+	for _, s := range d.Segments {
+		before += romSize(s.Old)
+		after += romSize(s.New)
+	}
+	return before, after
+}
+
+// RomDelta is how many bytes of rom the new build uses over the old one.
+func (d *SizeDiff) RomDelta() int64 {
+	before, after := d.RomSizes()
+	return after - before
+}
+
+// SegmentsOverBudget returns the segments whose rom size grew by more than
+// maxGrowth bytes, in segment order.
+func (d *SizeDiff) SegmentsOverBudget(maxGrowth int64) []*SegmentSizeDelta {
+	var out []*SegmentSizeDelta
+	for _, s := range d.Segments {
+		if s.Rom() > maxGrowth {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func formatDelta(delta int64) string {
+	if delta == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%+d", delta)
+}
+
+// WriteText writes a table of the size changes of every segment.
+func (d *SizeDiff) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "Segment\tText\tData\tBss\tRom\tOld rom\tNew rom\t")
+	for _, s := range d.Segments {
+		status := ""
+		if s.Old == nil {
+			status = "(added)"
+		} else if s.New == nil {
+			status = "(removed)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t0x%x\t0x%x\t%s\n", s.Segment,
+			formatDelta(s.Text()), formatDelta(s.Data()), formatDelta(s.Bss()), formatDelta(s.Rom()),
+			romSize(s.Old), romSize(s.New), status)
+	}
+	before, after := d.RomSizes()
+	fmt.Fprintf(tw, "Total\t\t\t\t%s\t0x%x\t0x%x\t\n", formatDelta(after-before), before, after)
+	return tw.Flush()
+}
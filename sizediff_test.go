@@ -0,0 +1,53 @@
+package spicy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffSizes(t *testing.T) {
+	assert := assert.New(t)
+	before := map[string]*SegmentSymbols{
+		"code": {RomStart: 0x1000, RomEnd: 0x1200, TextStart: 0x80000400, TextEnd: 0x80000500, DataStart: 0x80000500, DataEnd: 0x80000600, BssStart: 0x80000600, BssEnd: 0x80000700},
+		"gone": {RomStart: 0x1200, RomEnd: 0x1300, DataStart: 0x80001000, DataEnd: 0x80001100},
+	}
+	after := map[string]*SegmentSymbols{
+		"code":  {RomStart: 0x1000, RomEnd: 0x1240, TextStart: 0x80000400, TextEnd: 0x80000540, DataStart: 0x80000540, DataEnd: 0x80000640, BssStart: 0x80000640, BssEnd: 0x80000700},
+		"added": {RomStart: 0x1240, RomEnd: 0x1260, DataStart: 0x80001000, DataEnd: 0x80001020},
+	}
+	d := diffSizes(before, after)
+	if assert.Len(d.Segments, 3) {
+		assert.Equal("added", d.Segments[0].Segment)
+		code := d.Segments[1]
+		assert.Equal("code", code.Segment)
+		assert.Equal(int64(0x40), code.Text())
+		assert.Equal(int64(0), code.Data())
+		assert.Equal(int64(-0x40), code.Bss())
+		assert.Equal(int64(0x40), code.Rom())
+		assert.Equal(int64(-0x100), d.Segments[2].Rom())
+	}
+	assert.Equal(int64(0x40+0x20-0x100), d.RomDelta())
+	over := d.SegmentsOverBudget(0x20)
+	if assert.Len(over, 1) {
+		assert.Equal("code", over[0].Segment)
+	}
+	assert.Len(d.SegmentsOverBudget(0x1f), 2)
+	assert.Empty(d.SegmentsOverBudget(0x40))
+
+	var b bytes.Buffer
+	assert.Nil(d.WriteText(&b))
+	var rows [][]string
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		rows = append(rows, strings.Fields(line))
+	}
+	assert.Equal([][]string{
+		{"Segment", "Text", "Data", "Bss", "Rom", "Old", "rom", "New", "rom"},
+		{"added", "0", "+32", "0", "+32", "0x0", "0x20", "(added)"},
+		{"code", "+64", "0", "-64", "+64", "0x200", "0x240"},
+		{"gone", "0", "-256", "0", "-256", "0x100", "0x0", "(removed)"},
+		{"Total", "-160", "0x300", "0x260"},
+	}, rows)
+}
@@ -1,10 +1,8 @@
 package spicy
 
 import (
-	"container/list"
-	"errors"
+	"context"
 	"fmt"
-	"github.com/alecthomas/participle"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"os"
@@ -12,41 +10,29 @@ import (
 	"strings"
 )
 
-type Constant struct {
-	Symbol string `  @Ident`
-	Int    uint64 `| @Int`
-}
-
 type FlagAst struct {
-	Boot   bool `  @"BOOT"`
-	Object bool `| @"OBJECT"`
-	Raw    bool `| @"RAW"`
-}
-
-type Summand struct {
-	Lhs *Constant ` @@`
-	Op  string    `[ @("+" | "-")`
-	Rhs *Constant ` @@ ]`
+	Boot   bool
+	Object bool
+	Raw    bool
 }
 
 type MaxSegment struct {
-	First  string `"max[" @String ","`
-	Second string `    @String "]"`
+	First  string
+	Second string
 }
 
 type MinSegment struct {
-	First  string `"min[" @String ","`
-	Second string `       @String "]"`
+	First  string
+	Second string
 }
 
 // Only one of these values will be set.
 type Value struct {
-	String        string      `  @String`
-	Int           uint64      `| @Int`
-	Flags         []*FlagAst  `| @@ { @@ }`
-	ConstantValue *Summand    `| @@`
-	MaxSegment    *MaxSegment `| @@`
-	MinSegment    *MinSegment `| @@`
+	String     string
+	Flags      []*FlagAst
+	MaxSegment *MaxSegment
+	MinSegment *MinSegment
+	Expression *Expression
 }
 
 type StatementAst struct {
@@ -64,25 +50,49 @@ type StatementAst struct {
 	   |entry <symbol>
 	   |stack <stackValue>
 	*/
-	// I tried using @Ident here, but the parser was greedily taking 'endseg' as name.
-	// By explicitly listing all known names here, we limit the search space.
-	Name  string `@("name" | "address" | "after" | "include" | "maxsize" | "align" | "flags" | "number" | "entry" | "stack")`
-	Value Value  `@@`
+	Pos Position
+	Comments
+
+	Name  string
+	Value Value
+}
+
+// Comments holds the comments and cpp directives around an ast node, so
+// spicy fmt can write them back out.
+type Comments struct {
+	// Comments and directives on the lines before the node. An empty string
+	// stands for a blank line between them.
+	Leading []string
+	// A comment on the same line, after the node.
+	Trailing string
 }
 
 type SegmentAst struct {
-	Statements []*StatementAst `"beginseg" { @@ } "endseg"`
+	Pos Position
+	Comments
+	Statements []*StatementAst
+	// Comments before and after 'endseg'.
+	End Comments
 }
 
 type WaveAst struct {
-	Statements []*StatementAst `"beginwave" { @@ } "endwave"`
+	Pos Position
+	Comments
+	Statements []*StatementAst
+	// Comments before and after 'endwave'.
+	End Comments
 }
 
 type SpecAst struct {
-	Segments []*SegmentAst `{ @@ }`
-	Waves    []*WaveAst    `{ @@ }`
+	Segments []*SegmentAst
+	Waves    []*WaveAst
+	// Comments after the last block.
+	End Comments
 }
 
+// Segments are aligned to this in memory and ROM unless they specify 'align'.
+const defaultAlignment = 0x10
+
 type Flags struct {
 	Object bool
 	Boot   bool
@@ -102,6 +112,7 @@ type StackInfo struct {
 }
 
 type Segment struct {
+	Pos         Position
 	Name        string
 	Includes    []string
 	StackInfo   *StackInfo
@@ -110,9 +121,26 @@ type Segment struct {
 	MaxSize     uint64
 	Align       uint64
 	Flags       Flags
+
+	// Where each kind of statement was, the last one if it is repeated, so
+	// errors can point at it.
+	statementPos map[string]Position
+	// The address, after and number statements, which each place the
+	// segment, in spec order.
+	placements []Position
+}
+
+// posOf returns the position of the segment's last statement named name, or
+// of the segment itself if it has none.
+func (s *Segment) posOf(name string) Position {
+	if pos, ok := s.statementPos[name]; ok {
+		return pos
+	}
+	return s.Pos
 }
 
 type Wave struct {
+	Pos            Position
 	Name           string
 	ObjectSegments []*Segment
 	RawSegments    []*Segment
@@ -122,15 +150,49 @@ type Spec struct {
 	Waves []*Wave
 }
 
+// symbolic evaluates the statement's value as an expression which may be
+// relative to a symbol.
+func (s *StatementAst) symbolic() (exprValue, error) {
+	if s.Value.Expression == nil {
+		return exprValue{}, newSpecError(s.Pos, "Expected an expression for '%s'", s.Name)
+	}
+	v, err := s.Value.Expression.eval()
+	if err != nil {
+		return exprValue{}, newSpecError(s.Pos, "Invalid %s: %s", s.Name, err)
+	}
+	return v, nil
+}
+
+// constant evaluates the statement's value as a constant expression.
+func (s *StatementAst) constant() (uint64, error) {
+	if s.Value.Expression == nil {
+		return 0, newSpecError(s.Pos, "Expected a constant for '%s'", s.Name)
+	}
+	v, err := s.Value.Expression.evalConstant()
+	if err != nil {
+		return 0, newSpecError(s.Pos, "Invalid %s: %s", s.Name, err)
+	}
+	return v, nil
+}
+
 func convertSegmentAst(s *SegmentAst) (*Segment, error) {
-	seg := &Segment{}
+	seg := &Segment{Pos: s.Pos, statementPos: map[string]Position{}}
 	for _, statement := range s.Statements {
+		seg.statementPos[statement.Name] = statement.Pos
+		switch statement.Name {
+		case "address", "after", "number":
+			seg.placements = append(seg.placements, statement.Pos)
+		}
 		switch statement.Name {
 		case "name":
 			seg.Name = statement.Value.String
 			break
 		case "address":
-			seg.Positioning.Address = statement.Value.Int
+			address, err := statement.constant()
+			if err != nil {
+				return nil, err
+			}
+			seg.Positioning.Address = address
 			break
 		case "after":
 			if statement.Value.String != "" {
@@ -140,7 +202,7 @@ func convertSegmentAst(s *SegmentAst) (*Segment, error) {
 			} else if statement.Value.MaxSegment != nil {
 				seg.Positioning.AfterMaxSegment = [2]string{statement.Value.MaxSegment.First, statement.Value.MaxSegment.Second}
 			} else {
-				return nil, errors.New("No value found in 'after' statement")
+				return nil, newSpecError(statement.Pos, "No value found in 'after' statement")
 			}
 			break
 		case "include":
@@ -152,10 +214,21 @@ func convertSegmentAst(s *SegmentAst) (*Segment, error) {
 			seg.Includes = append(seg.Includes, replaced)
 			break
 		case "maxsize":
-			seg.MaxSize = statement.Value.Int
+			maxSize, err := statement.constant()
+			if err != nil {
+				return nil, err
+			}
+			seg.MaxSize = maxSize
 			break
 		case "align":
-			seg.Align = statement.Value.Int
+			align, err := statement.constant()
+			if err != nil {
+				return nil, err
+			}
+			if align == 0 || align&(align-1) != 0 {
+				return nil, newSpecError(statement.Pos, "Alignment 0x%x must be a power of two", align)
+			}
+			seg.Align = align
 			break
 		case "flags":
 			for _, f := range statement.Value.Flags {
@@ -169,33 +242,49 @@ func convertSegmentAst(s *SegmentAst) (*Segment, error) {
 			}
 			break
 		case "number":
-			seg.Positioning.Address = statement.Value.Int * 0x1000000
+			number, err := statement.constant()
+			if err != nil {
+				return nil, err
+			}
+			if number > 0xff {
+				return nil, newSpecError(statement.Pos, "Segment number %d is out of range", number)
+			}
+			seg.Positioning.Address = number * 0x1000000
 			// Don't do anything, as we don't really care here.
 			// All that matters for code is the rom address.
 			break
 		case "entry":
-			seg.Entry = &statement.Value.ConstantValue.Lhs.Symbol
+			entry, err := statement.symbolic()
+			if err != nil {
+				return nil, err
+			}
+			if entry.Symbol == "" || entry.Offset != 0 {
+				return nil, newSpecError(statement.Pos, "Entry must be a single symbol")
+			}
+			seg.Entry = &entry.Symbol
 			break
 		case "stack":
+			stack, err := statement.symbolic()
+			if err != nil {
+				return nil, err
+			}
 			seg.StackInfo = &StackInfo{}
-			if statement.Value.ConstantValue.Lhs.Symbol != "" {
-				seg.StackInfo.Start = statement.Value.ConstantValue.Lhs.Symbol
+			if stack.Symbol != "" {
+				seg.StackInfo.Start = stack.Symbol
+				seg.StackInfo.Offset = stack.Offset
 			} else {
-				seg.StackInfo.Start = fmt.Sprint(statement.Value.ConstantValue.Lhs.Int)
-			}
-			if statement.Value.ConstantValue.Rhs.Int != 0 {
-				seg.StackInfo.Offset = statement.Value.ConstantValue.Rhs.Int
+				seg.StackInfo.Start = fmt.Sprint(stack.Offset)
 			}
 			break
 		default:
-			return nil, errors.New(fmt.Sprintf("Unknown name %s", statement.Name))
+			return nil, newSpecError(statement.Pos, "Unknown name %s", statement.Name)
 		}
 	}
 	return seg, nil
 }
 
 func convertWaveAst(s *WaveAst, segments map[string]*Segment) (*Wave, error) {
-	out := &Wave{}
+	out := &Wave{Pos: s.Pos}
 	for _, statement := range s.Statements {
 		switch statement.Name {
 		case "name":
@@ -205,7 +294,7 @@ func convertWaveAst(s *WaveAst, segments map[string]*Segment) (*Wave, error) {
 			seg := segments[statement.Value.String]
 
 			if seg == nil {
-				return nil, errors.New(fmt.Sprintf("Undefined segment '%s' included in wave", statement.Value.String));
+				return nil, newSpecError(statement.Pos, "Undefined segment '%s' included in wave", statement.Value.String)
 			} else if seg.Flags.Object {
 				out.ObjectSegments = append(out.ObjectSegments, seg)
 			} else if seg.Flags.Raw {
@@ -213,7 +302,7 @@ func convertWaveAst(s *WaveAst, segments map[string]*Segment) (*Wave, error) {
 			}
 			break
 		default:
-			return nil, errors.New(fmt.Sprintf("Unknown name %s", statement.Name))
+			return nil, newSpecError(statement.Pos, "Unknown name %s", statement.Name)
 		}
 	}
 	return out, nil
@@ -253,8 +342,14 @@ func convertAstToSpec(s SpecAst) (*Spec, error) {
 	return out, nil
 }
 
-func PreprocessSpec(file io.Reader, gcc Runner, includeFlags []string, defineFlags []string, undefineFlags []string) (io.Reader, error) {
-	args := []string{"-P", "-E", "-U_LANGUAGE_C", "-D_LANGUAGE_MAKEROM", "-"}
+func PreprocessSpec(ctx context.Context, file io.Reader, gcc Runner, includeFlags []string, defineFlags []string, undefineFlags []string) (io.Reader, error) {
+	return RunContext(ctx, gcc, file, preprocessArgs(includeFlags, defineFlags, undefineFlags))
+}
+
+func preprocessArgs(includeFlags []string, defineFlags []string, undefineFlags []string) []string {
+	// Line markers are kept (no -P) so ParseNamedSpec can report errors
+	// against the original files.
+	args := []string{"-E", "-U_LANGUAGE_C", "-D_LANGUAGE_MAKEROM", "-"}
 	for _, include := range includeFlags {
 		args = append(args, fmt.Sprintf("-I%s", include))
 	}
@@ -264,104 +359,159 @@ func PreprocessSpec(file io.Reader, gcc Runner, includeFlags []string, defineFla
 	for _, undefine := range undefineFlags {
 		args = append(args, fmt.Sprintf("-U%s", undefine))
 	}
-
-	return gcc.Run(file, args)
+	return args
 }
 
+// ParseSpec parses a spec read from stdin.
 func ParseSpec(r io.Reader) (*Spec, error) {
+	return ParseNamedSpec(r, stdinFilename)
+}
+
+// ParseNamedSpec parses preprocessed spec text. Errors are reported as
+// *SpecError against the original sources named in cpp's line markers, with
+// filename used for text that has none.
+func ParseNamedSpec(r io.Reader, filename string) (*Spec, error) {
 	log.Infof("Parsing spec")
-	parser, err := participle.Build(&SpecAst{})
+	sources, text, err := newSourceMap(r, filename)
 	if err != nil {
 		return nil, err
 	}
-
-	specAst := &SpecAst{}
-	err = parser.Parse(r, specAst)
+	specAst, err := parseSpecAst(text, filename)
 	if err != nil {
-		return nil, err
+		if e, ok := err.(*SpecError); ok {
+			e.Pos = sources.resolve(e.Pos)
+		}
+		return nil, sources.annotate(err)
 	}
+	sources.resolvePositions(specAst)
 	out, err := convertAstToSpec(*specAst)
 	if err != nil {
-		return nil, err
+		return nil, sources.annotate(err)
 	}
 	log.Debugf("Parsed: %v", out)
 	for _, w := range out.Waves {
-		w.correctOrdering()
+		if err := w.correctOrdering(); err != nil {
+			return nil, sources.annotate(err)
+		}
 	}
-	return out, err
+	return out, nil
 }
 
 func (w *Wave) checkValidity() error {
 	for _, seg := range w.ObjectSegments {
-		numSet := 0
 		if seg.Name == "" {
-			return errors.New("Name must be non-empty.")
+			return newSpecError(seg.Pos, "Name must be non-empty.")
 		}
 		if seg.Flags.Boot && seg.StackInfo == nil {
-			return errors.New("Boot segments must have stack info specified.")
+			return newSpecError(seg.posOf("flags"), "Boot segments must have stack info specified.")
 		}
 		if seg.Flags.Boot && seg.Entry == nil {
-			return errors.New("Boot segments must have entry point specified.")
-		}
-		if seg.Positioning.Address > 0 {
-			numSet++
-		}
-		if seg.Positioning.AfterSegment != "" {
-			numSet++
-		}
-		if seg.Positioning.AfterMinSegment[0] != "" {
-			numSet++
+			return newSpecError(seg.posOf("flags"), "Boot segments must have entry point specified.")
 		}
-		if seg.Positioning.AfterMaxSegment[0] != "" {
-			numSet++
+		// The second placement is the one that conflicts.
+		if len(seg.placements) > 1 {
+			return newSpecError(seg.placements[1], "Too many addressing sections specified in segment %s.", seg.Name)
 		}
-		if numSet > 1 {
-			return errors.New(fmt.Sprintf("Too many addressing sections specified in segment %s.", seg.Name))
+		if seg.Align != 0 && seg.Positioning.Address%seg.Align != 0 {
+			pos := seg.Pos
+			if len(seg.placements) == 1 {
+				pos = seg.placements[0]
+			}
+			return newSpecError(pos, "Address 0x%x of segment %s is not aligned to 0x%x.", seg.Positioning.Address, seg.Name, seg.Align)
 		}
 	}
 	// Per-spec checks
 	// Wave checks
+	if w.GetBootSegment() == nil {
+		return newSpecError(w.Pos, "Wave %s has no boot segment", w.Name)
+	}
 	return nil
 }
 
-func findElement(l *list.List, name string) *list.Element {
-	for e := l.Front(); e != nil; e = e.Next() {
-		original, _ := e.Value.(*Segment)
-		if original.Name == name {
-			return e
+// dependencies returns the names of the segments that seg must be placed
+// after.
+func (seg *Segment) dependencies() []string {
+	var deps []string
+	for _, name := range []string{
+		seg.Positioning.AfterSegment,
+		seg.Positioning.AfterMinSegment[0],
+		seg.Positioning.AfterMinSegment[1],
+		seg.Positioning.AfterMaxSegment[0],
+		seg.Positioning.AfterMaxSegment[1],
+	} {
+		if name != "" {
+			deps = append(deps, name)
 		}
 	}
-	return nil
+	return deps
 }
 
-func (w *Wave) correctOrdering() {
-	// TODO(trhodeos): Make this actually correct. This just places any
-	// explicitly addressed segments before any 'after.*' segments. If
-	// 'after' segments depend on other 'after' segments, this'll break.
-	/*l := list.New()
+// correctOrdering sorts the object segments of the wave so that every segment
+// comes after the segments it is positioned relative to. Segments without
+// dependencies between them keep their spec order.
+func (w *Wave) correctOrdering() error {
+	byName := map[string]*Segment{}
 	for _, seg := range w.ObjectSegments {
-		if seg.Positioning.Address != 0 {
-			l.PushBack(seg)
+		byName[seg.Name] = seg
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := map[string]int{}
+	var stack []string
+	ordered := make([]*Segment, 0, len(w.ObjectSegments))
+
+	var visit func(seg *Segment) error
+	visit = func(seg *Segment) error {
+		switch state[seg.Name] {
+		case done:
+			return nil
+		case visiting:
+			start := 0
+			for i, name := range stack {
+				if name == seg.Name {
+					start = i
+					break
+				}
+			}
+			cycle := append(append([]string{}, stack[start:]...), seg.Name)
+			return newSpecError(seg.Pos, "Cyclic segment ordering in wave %s: %s", w.Name, strings.Join(cycle, " -> "))
+		}
+		state[seg.Name] = visiting
+		stack = append(stack, seg.Name)
+		for _, dep := range seg.dependencies() {
+			depSeg := byName[dep]
+			if depSeg == nil {
+				return newSpecError(seg.Pos, "Segment %s is placed after segment %s, which is not an object segment in wave %s", seg.Name, dep, w.Name)
+			}
+			if err := visit(depSeg); err != nil {
+				return err
+			}
 		}
+		stack = stack[:len(stack)-1]
+		state[seg.Name] = done
+		ordered = append(ordered, seg)
+		return nil
 	}
+
 	for _, seg := range w.ObjectSegments {
-		if seg.Positioning.Address == 0 {
-			e := findElement(l, seg.Positioning.AfterSegment)
-			if e != nil {
-				l.InsertAfter(seg, e)
-			} else {
-				l.PushBack(seg)
-			}
+		if err := visit(seg); err != nil {
+			return err
 		}
 	}
+	w.ObjectSegments = ordered
+	return nil
+}
 
-	newSegments := make([]*Segment, 0)
-	for e := l.Front(); e != nil; e = e.Next() {
-		original, _ := e.Value.(*Segment)
-		newSegments = append(newSegments, original)
+// Alignment returns the alignment of the segment in both memory and ROM.
+func (s *Segment) Alignment() uint64 {
+	if s.Align == 0 {
+		return defaultAlignment
 	}
-	w.ObjectSegments = newSegments
-	*/
+	return s.Align
 }
 
 func (w *Wave) GetBootSegment() *Segment {
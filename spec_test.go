@@ -12,7 +12,9 @@ func TestParsingSimpleSpec(t *testing.T) {
 	specStr := `
 beginseg
   name "obj"
-  flags OBJECT
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
   include "some/file"
   address 0x12
 endseg
@@ -45,7 +47,9 @@ func TestParsingIncludesWithRoot(t *testing.T) {
 	specStr := `
 beginseg
   name "some_segment"
-  flags OBJECT
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
   include "some/file"
   include "$(ROOT)/some/file"
 endseg
@@ -63,3 +67,259 @@ endwave
 	assert.Equal("some/file", spec.Waves[0].ObjectSegments[0].Includes[0])
 	assert.Equal("parent/some/file", spec.Waves[0].ObjectSegments[0].Includes[1])
 }
+
+func TestParsingOrdersChainedAfterSegments(t *testing.T) {
+	assert := assert.New(t)
+	specStr := `
+beginseg
+  name "c"
+  flags OBJECT
+  after "b"
+endseg
+beginseg
+  name "b"
+  flags OBJECT
+  after max["a", "d"]
+endseg
+beginseg
+  name "a"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  address 0x80000400
+endseg
+beginseg
+  name "d"
+  flags OBJECT
+  after "a"
+endseg
+beginwave
+  name "wave"
+  include "c"
+  include "b"
+  include "a"
+  include "d"
+endwave
+`
+	spec, err := ParseSpec(strings.NewReader(specStr))
+	assert.Nil(err)
+	var names []string
+	for _, seg := range spec.Waves[0].ObjectSegments {
+		names = append(names, seg.Name)
+	}
+	assert.Equal([]string{"a", "d", "b", "c"}, names)
+}
+
+func TestParsingReportsOrderingCycle(t *testing.T) {
+	assert := assert.New(t)
+	specStr := `
+beginseg
+  name "a"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  after "b"
+endseg
+beginseg
+  name "b"
+  flags OBJECT
+  after "a"
+endseg
+beginwave
+  name "wave"
+  include "a"
+  include "b"
+endwave
+`
+	_, err := ParseSpec(strings.NewReader(specStr))
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "a -> b -> a")
+}
+
+func TestParseErrorsPointAtOriginalSource(t *testing.T) {
+	assert := assert.New(t)
+	specStr := `# 1 "<stdin>"
+# 1 "<built-in>"
+# 1 "<command-line>"
+# 1 "<stdin>"
+beginseg
+  name "a"
+  flags OBJECT
+# 1 "include/addr.h" 1
+  address 0x80000400
+# 7 "<stdin>" 2
+  after "b"
+endseg
+beginwave
+  name "wave"
+  include "a"
+endwave
+`
+	_, err := ParseNamedSpec(strings.NewReader(specStr), "game.spec")
+	specErr, ok := err.(*SpecError)
+	assert.True(ok)
+	// The conflicting after statement comes back from the include.
+	assert.Equal(Position{Filename: "game.spec", Line: 7, Column: 3}, specErr.Pos)
+
+	specStr = `# 1 "<stdin>"
+beginseg
+# 4 "<stdin>"
+  name "a"
+  flags OBJECT
+  bogus "b"
+endseg
+`
+	_, err = ParseNamedSpec(strings.NewReader(specStr), "game.spec")
+	specErr, ok = err.(*SpecError)
+	assert.True(ok)
+	assert.Equal(Position{Filename: "game.spec", Line: 6, Column: 3}, specErr.Pos)
+	assert.Equal("  bogus \"b\"", specErr.Excerpt)
+	assert.True(strings.HasPrefix(err.Error(), "game.spec:6:3: "))
+	assert.True(strings.HasSuffix(err.Error(), "\n  bogus \"b\"\n  ^"))
+}
+
+func TestParsingExpressions(t *testing.T) {
+	assert := assert.New(t)
+	specStr := `
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack + 0x2000 * 2
+  address 0x80000400 + 0x100000 * 2
+  maxsize (1 << 20) - 0x100 | 0x10
+  align 0x20 & ~0xf
+endseg
+beginwave
+  name "wave"
+  include "code"
+endwave
+`
+	spec, err := ParseSpec(strings.NewReader(specStr))
+	assert.Nil(err)
+	code := spec.Waves[0].ObjectSegments[0]
+	assert.Equal("boot", *code.Entry)
+	assert.Equal(&StackInfo{Start: "bootStack", Offset: 0x4000}, code.StackInfo)
+	assert.Equal(uint64(0x80200400), code.Positioning.Address)
+	assert.Equal(uint64(0xfff10), code.MaxSize)
+	assert.Equal(uint64(0x20), code.Align)
+}
+
+func TestParsingUnsigned64BitExpressions(t *testing.T) {
+	assert := assert.New(t)
+	for expr, want := range map[string]uint64{
+		"0xffffffff80000400":         0xffffffff80000400,
+		"0x8000000000000000 + 0x400": 0x8000000000000400,
+		"~0 & ~0xfff":                0xfffffffffffff000,
+		"(0x10 - 0x8) * 2":           0x10,
+	} {
+		specStr := `
+beginseg
+  name "code"
+  flags BOOT OBJECT
+  entry boot
+  stack bootStack
+  address ` + expr + `
+endseg
+beginwave
+  name "wave"
+  include "code"
+endwave
+`
+		spec, err := ParseSpec(strings.NewReader(specStr))
+		if assert.NoError(err, expr) {
+			assert.Equal(want, spec.Waves[0].ObjectSegments[0].Positioning.Address, expr)
+		}
+	}
+}
+
+func TestParsingExpressionErrors(t *testing.T) {
+	assert := assert.New(t)
+	for expr, msg := range map[string]string{
+		"0xffffffffffffffff + 1": "integer overflow",
+		"0x8000000000000000 * 2": "integer overflow",
+		"-1":                     "must not be negative",
+		"1 << 64":                "Invalid shift count 64",
+		"0x10000000000000000":    "overflows 64 bits",
+		"4 / (2 - 2)":            "Division by zero",
+		"someSymbol":             "Expected a constant",
+		"0 - 1":                  "must not be negative",
+	} {
+		specStr := `
+beginseg
+  name "code"
+  flags OBJECT
+  address ` + expr + `
+endseg
+`
+		_, err := ParseSpec(strings.NewReader(specStr))
+		if assert.NotNil(err, expr) {
+			assert.Contains(err.Error(), msg, expr)
+		}
+	}
+}
+
+func TestParsingRejectsBadAlignment(t *testing.T) {
+	assert := assert.New(t)
+	specStr := `
+beginseg
+  name "code"
+  flags OBJECT
+  align 0x30
+endseg
+`
+	_, err := ParseSpec(strings.NewReader(specStr))
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "must be a power of two")
+	}
+}
+
+func TestValidationErrorsPointAtStatement(t *testing.T) {
+	assert := assert.New(t)
+	specs := []struct {
+		spec    string
+		pos     Position
+		excerpt string
+	}{
+		{`beginseg
+	name "a"
+	flags OBJECT
+	address 0x80000400
+	address 0x80100000
+endseg
+`, Position{Filename: "game.spec", Line: 5, Column: 2}, "\taddress 0x80100000\n\t^"},
+		{`beginseg
+	name "a"
+	flags OBJECT
+	after "b"
+	  number 3
+endseg
+`, Position{Filename: "game.spec", Line: 5, Column: 4}, "\t  number 3\n\t  ^"},
+		{`beginseg
+	name "a"
+	flags OBJECT
+	align 0x1000
+	address 0x80000400
+endseg
+`, Position{Filename: "game.spec", Line: 5, Column: 2}, "\taddress 0x80000400\n\t^"},
+		{`beginseg
+	name "a"
+	flags BOOT OBJECT
+	entry boot
+endseg
+`, Position{Filename: "game.spec", Line: 3, Column: 2}, "\tflags BOOT OBJECT\n\t^"},
+	}
+	for _, s := range specs {
+		specStr := s.spec + `beginwave
+	name "wave"
+	include "a"
+endwave
+`
+		_, err := ParseNamedSpec(strings.NewReader(specStr), "game.spec")
+		specErr, ok := err.(*SpecError)
+		if assert.True(ok, s.spec) {
+			assert.Equal(s.pos, specErr.Pos, s.spec)
+			assert.True(strings.HasSuffix(err.Error(), s.excerpt), err.Error())
+		}
+	}
+}
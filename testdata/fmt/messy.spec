@@ -0,0 +1,18 @@
+/* Header comment. */
+
+#include "defs.h"
+beginseg   // the code
+include "code.o"
+    name "code"
+      flags BOOT   OBJECT
+   stack boot_stack+STACKSIZE
+	entry boot
+#ifdef DEBUG
+include "debug.o"
+#endif
+  include  "$(ROOT)/lib.o"
+	// before end
+endseg
+beginwave name "w"
+ include "code" endwave
+// trailing file comment
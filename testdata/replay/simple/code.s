@@ -0,0 +1,22 @@
+# Boot segment for the replay tests. Assembled into code.o when recording.
+	.set	noreorder
+	.text
+	.globl	boot
+boot:
+	la	$t0, counter
+loop:
+	lw	$t1, 0($t0)
+	addiu	$t1, $t1, 1
+	j	loop
+	sw	$t1, 0($t0)
+
+	.data
+	.globl	counter
+counter:
+	.word	0
+
+	.bss
+	.globl	boot_stack
+	.align	3
+boot_stack:
+	.space	0x2000
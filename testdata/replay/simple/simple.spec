@@ -0,0 +1,12 @@
+beginseg
+	name	"code"
+	flags	BOOT OBJECT
+	entry	boot
+	stack	boot_stack + 0x2000
+	include	"testdata/replay/simple/code.o"
+endseg
+
+beginwave
+	name	"simple"
+	include	"code"
+endwave
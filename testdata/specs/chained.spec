@@ -0,0 +1,35 @@
+# 1 "<stdin>"
+# 1 "<built-in>"
+# 1 "<command-line>"
+# 1 "<stdin>"
+beginseg
+	name "code"
+	flags BOOT OBJECT
+	entry boot
+	stack 0x80400000
+	include "code.o"
+endseg
+
+# 1 "extra.spec" 1
+beginseg
+	name "extra"
+	flags OBJECT
+	after "code"
+	include "extra.o"
+endseg
+# 12 "<stdin>" 2
+
+beginseg
+	name "last"
+	flags OBJECT
+	after min["code", "extra"]
+	align 0x1000
+	include "last.o"
+endseg
+
+beginwave
+	name "chained"
+	include "code"
+	include "extra"
+	include "last"
+endwave
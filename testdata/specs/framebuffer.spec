@@ -0,0 +1,36 @@
+/*
+ * A boot segment pulling in the rsp microcode, a color frame buffer at a
+ * fixed address and a numbered segment.
+ */
+#include "../../include/PR/rcp.h"
+
+beginseg
+	name	"code"
+	flags	BOOT OBJECT
+	entry 	boot
+	stack	boot_stack + 0x2000
+	include "codesegment.o"
+	include "$(ROOT)/usr/lib/PR/rspboot.o"
+	include "$(ROOT)/usr/lib/PR/gspF3DEX2.fifo.o"
+endseg
+
+beginseg
+	name	"cfb"
+	flags	OBJECT
+	address	0x80200000
+	include "cfb.o"
+endseg
+
+beginseg
+	name	"static"
+	flags	OBJECT
+	number	1
+	include "static.o"
+endseg
+
+beginwave
+	name	"framebuffer"
+	include	"code"
+	include	"cfb"
+	include	"static"
+endwave
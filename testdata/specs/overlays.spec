@@ -0,0 +1,47 @@
+// Two overlays sharing an address, loaded after whichever of the
+// fixed segments ends last.
+beginseg
+	name "code"
+	flags BOOT OBJECT
+	entry boot
+	stack boot_stack + 0x2000
+	include "codesegment.o"
+endseg
+
+beginseg
+	name "texture"
+	flags RAW
+	include "texture.bin"
+endseg
+
+beginseg
+	name "zbuffer"
+	flags OBJECT
+	address 0x80000400 + (1 << 20)
+	align 0x40
+	maxsize 320 * 240 * 2
+	include "zbuffer.o"
+endseg
+
+beginseg
+	name "ovl1"
+	flags OBJECT
+	after max["code", "zbuffer"]
+	include "ovl1.o"	/* first overlay */
+endseg
+
+beginseg
+	name "ovl2"
+	flags OBJECT
+	after max["code", "zbuffer"]
+	include "ovl2.o"
+endseg
+
+beginwave
+	name "game"
+	include "code"
+	include "texture"
+	include "zbuffer"
+	include "ovl1"
+	include "ovl2"
+endwave
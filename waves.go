@@ -0,0 +1,157 @@
+package spicy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/trhodeos/n64rom"
+)
+
+// LinkedWave is a wave that has been linked and placed in rom.
+type LinkedWave struct {
+	Wave     *Wave
+	RomStart uint64
+	RomEnd   uint64
+	// The linked ELF file.
+	Object []byte
+}
+
+func waveRomStartSymbol(w *Wave) string {
+	return fmt.Sprintf("_%sWaveRomStart", w.Name)
+}
+
+func waveRomEndSymbol(w *Wave) string {
+	return fmt.Sprintf("_%sWaveRomEnd", w.Name)
+}
+
+// waveSymbols returns the symbols giving the rom range of every wave.
+func waveSymbols(linked []*LinkedWave) []Symbol {
+	var out []Symbol
+	for _, l := range linked {
+		out = append(out,
+			Symbol{Name: waveRomStartSymbol(l.Wave), Value: l.RomStart},
+			Symbol{Name: waveRomEndSymbol(l.Wave), Value: l.RomEnd})
+	}
+	return out
+}
+
+// wavePlaceholders returns placeholders for the wave symbols that aren't
+// known yet when waves[i] is first linked: its own rom end and the rom range
+// of every wave after it.
+func wavePlaceholders(waves []*Wave, i int) []Symbol {
+	out := []Symbol{{Name: waveRomEndSymbol(waves[i]), Provide: true}}
+	for _, w := range waves[i+1:] {
+		out = append(out,
+			Symbol{Name: waveRomStartSymbol(w), Provide: true},
+			Symbol{Name: waveRomEndSymbol(w), Provide: true})
+	}
+	return out
+}
+
+// linkWave links w to start at romStart. symbols must define the wave's own
+// rom start symbol. It also reports whether the wave refers to any of the
+// placeholder symbols.
+func linkWave(ctx context.Context, dir string, w *Wave, romStart uint64, ld Runner, entry []byte, rawObjects map[string][]byte, symbols []Symbol) (*LinkedWave, bool, error) {
+	l, usesPlaceholders, err := linkWaveObject(ctx, dir, w, romStart, ld, entry, rawObjects, symbols)
+	if err != nil {
+		return nil, false, &LinkError{Wave: w.Name, Err: err}
+	}
+	return l, usesPlaceholders, nil
+}
+
+func linkWaveObject(ctx context.Context, dir string, w *Wave, romStart uint64, ld Runner, entry []byte, rawObjects map[string][]byte, symbols []Symbol) (*LinkedWave, bool, error) {
+	rawReaders := map[string]io.Reader{}
+	for include, obj := range rawObjects {
+		rawReaders[include] = bytes.NewReader(obj)
+	}
+	linked, err := LinkSpec(ctx, dir, w, ld, bytes.NewReader(entry), rawReaders, symbols...)
+	if err != nil {
+		return nil, false, err
+	}
+	object, err := ioutil.ReadAll(linked)
+	if err != nil {
+		return nil, false, err
+	}
+	defined, err := ReadSymbols(bytes.NewReader(object))
+	if err != nil {
+		return nil, false, err
+	}
+	romEnd, ok := defined["_RomEnd"]
+	if !ok {
+		return nil, false, errors.New("Symbol _RomEnd not found")
+	}
+	usesPlaceholders := false
+	for _, sym := range symbols {
+		if _, ok := defined[sym.Name]; ok && sym.Provide {
+			usesPlaceholders = true
+		}
+	}
+	return &LinkedWave{Wave: w, RomStart: romStart, RomEnd: romEnd, Object: object}, usesPlaceholders, nil
+}
+
+// LinkWaves links every wave in the spec, placing them one after another in
+// rom starting at n64rom.CodeStart. Each wave can refer to the rom range of
+// every wave through the _<name>WaveRomStart and _<name>WaveRomEnd symbols.
+// Intermediate files are written to the scratch directory dir.
+func LinkWaves(ctx context.Context, dir string, spec *Spec, as Runner, ld Runner, symbols []Symbol) ([]*LinkedWave, error) {
+	entries := map[*Wave][]byte{}
+	rawObjects := map[*Wave]map[string][]byte{}
+	for _, w := range spec.Waves {
+		objs, err := WrapRawSegments(ctx, dir, w, ld)
+		if err != nil {
+			return nil, &LinkError{Wave: w.Name, Err: err}
+		}
+		rawObjects[w] = objs
+		entry, err := CreateEntryBinary(ctx, dir, w, as)
+		if err == nil {
+			entries[w], err = ioutil.ReadAll(entry)
+		}
+		if err != nil {
+			return nil, &LinkError{Wave: w.Name, Err: err}
+		}
+	}
+
+	// A wave's placement only depends on its own rom start, so the waves are
+	// sized and placed in order, with placeholders for the symbols of the
+	// waves not placed yet.
+	var linked []*LinkedWave
+	var relink []int
+	romStart := uint64(n64rom.CodeStart)
+	for i, w := range spec.Waves {
+		waveSyms := append(append([]Symbol{}, symbols...), waveSymbols(linked)...)
+		waveSyms = append(waveSyms, Symbol{Name: waveRomStartSymbol(w), Value: romStart})
+		waveSyms = append(waveSyms, wavePlaceholders(spec.Waves, i)...)
+		l, usesPlaceholders, err := linkWave(ctx, dir, w, romStart, ld, entries[w], rawObjects[w], waveSyms)
+		if err != nil {
+			return nil, err
+		}
+		linked = append(linked, l)
+		if usesPlaceholders {
+			relink = append(relink, i)
+		}
+		romStart = (l.RomEnd + defaultAlignment - 1) &^ (defaultAlignment - 1)
+	}
+
+	// Waves that refer to symbols that were placeholders are linked again
+	// with the final placement. Absolute symbols don't change section
+	// sizes, so the placement stays the same.
+	all := append(append([]Symbol{}, symbols...), waveSymbols(linked)...)
+	for _, i := range relink {
+		l := linked[i]
+		log.Infof("Relinking wave %s with final rom placement.", l.Wave.Name)
+		relinked, _, err := linkWave(ctx, dir, l.Wave, l.RomStart, ld, entries[l.Wave], rawObjects[l.Wave], all)
+		if err != nil {
+			return nil, err
+		}
+		if relinked.RomEnd != l.RomEnd {
+			return nil, &LinkError{Wave: l.Wave.Name, Err: errors.New(fmt.Sprintf("Wave changed size from 0x%x to 0x%x bytes when relinked", l.RomEnd-l.RomStart, relinked.RomEnd-relinked.RomStart))}
+		}
+		linked[i] = relinked
+	}
+	return linked, nil
+}
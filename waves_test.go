@@ -0,0 +1,233 @@
+package spicy
+
+import (
+	"bytes"
+	"context"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// elfWithSymbols returns a big-endian MIPS ELF file holding nothing but the
+// given absolute symbols.
+func elfWithSymbols(symbols map[string]uint64) []byte {
+	var names []string
+	for name := range symbols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	strtab := []byte{0}
+	symtab := &bytes.Buffer{}
+	binary.Write(symtab, binary.BigEndian, elf.Sym32{})
+	for _, name := range names {
+		binary.Write(symtab, binary.BigEndian, elf.Sym32{
+			Name:  uint32(len(strtab)),
+			Value: uint32(symbols[name]),
+			Info:  elf.ST_INFO(elf.STB_GLOBAL, elf.STT_NOTYPE),
+			Shndx: uint16(elf.SHN_ABS),
+		})
+		strtab = append(append(strtab, name...), 0)
+	}
+	shstrtab := []byte("\x00.symtab\x00.strtab\x00.shstrtab\x00")
+
+	const headerSize = 52
+	symtabOff := uint32(headerSize)
+	strtabOff := symtabOff + uint32(symtab.Len())
+	shstrtabOff := strtabOff + uint32(len(strtab))
+	sectionsOff := shstrtabOff + uint32(len(shstrtab))
+	sections := []elf.Section32{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_SYMTAB), Off: symtabOff, Size: uint32(symtab.Len()), Link: 2, Info: 1, Addralign: 4, Entsize: 16},
+		{Name: 9, Type: uint32(elf.SHT_STRTAB), Off: strtabOff, Size: uint32(len(strtab)), Addralign: 1},
+		{Name: 17, Type: uint32(elf.SHT_STRTAB), Off: shstrtabOff, Size: uint32(len(shstrtab)), Addralign: 1},
+	}
+
+	out := &bytes.Buffer{}
+	header := elf.Header32{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_MIPS),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     sectionsOff,
+		Ehsize:    headerSize,
+		Shentsize: 40,
+		Shnum:     uint16(len(sections)),
+		Shstrndx:  3,
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2MSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	binary.Write(out, binary.BigEndian, header)
+	out.Write(symtab.Bytes())
+	out.Write(strtab)
+	out.Write(shstrtab)
+	binary.Write(out, binary.BigEndian, sections)
+	return out.Bytes()
+}
+
+// fakeAs writes an empty object.
+type fakeAs struct {
+	runs int
+}
+
+func (f *fakeAs) Run(r io.Reader, args []string) (io.Reader, error) {
+	f.runs++
+	for i, arg := range args {
+		if arg == "-o" {
+			return nil, ioutil.WriteFile(args[i+1], nil, 0644)
+		}
+	}
+	return nil, fmt.Errorf("no -o in %v", args)
+}
+
+var (
+	waveOfScriptRegexp = regexp.MustCompile(`DEFINED\(_(\w+)WaveRomStart\)`)
+	provideRegexp      = regexp.MustCompile(`PROVIDE\((\w+) = (\w+)\);`)
+)
+
+// fakeWaveLd links waves of a fixed size, resolving the symbols each wave
+// refers to like ld would: from --defsym, then from PROVIDE in the script.
+type fakeWaveLd struct {
+	sizes map[string]uint64
+	refs  map[string][]string
+	links map[string]int
+}
+
+func (f *fakeWaveLd) Run(r io.Reader, args []string) (io.Reader, error) {
+	defined := map[string]uint64{}
+	var script, output string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--defsym":
+			i++
+			parts := strings.SplitN(args[i], "=", 2)
+			v, err := strconv.ParseUint(parts[1], 0, 64)
+			if err != nil {
+				return nil, err
+			}
+			defined[parts[0]] = v
+		case "-dT":
+			i++
+			script = args[i]
+		case "-o":
+			i++
+			output = args[i]
+		}
+	}
+	b, err := ioutil.ReadFile(script)
+	if err != nil {
+		return nil, err
+	}
+	wave := waveOfScriptRegexp.FindStringSubmatch(string(b))[1]
+	f.links[wave]++
+	provided := map[string]uint64{}
+	for _, m := range provideRegexp.FindAllStringSubmatch(string(b), -1) {
+		provided[m[1]], _ = strconv.ParseUint(m[2], 0, 64)
+	}
+
+	start := defined["_"+wave+"WaveRomStart"]
+	symbols := map[string]uint64{"_RomEnd": start + f.sizes[wave]}
+	for _, ref := range f.refs[wave] {
+		if v, ok := defined[ref]; ok {
+			symbols[ref] = v
+		} else if v, ok := provided[ref]; ok {
+			symbols[ref] = v
+		} else {
+			return nil, fmt.Errorf("undefined reference to `%s'", ref)
+		}
+	}
+	return nil, ioutil.WriteFile(output, elfWithSymbols(symbols), 0644)
+}
+
+const twoWaveSpec = `
+beginseg
+	name "a"
+	flags BOOT OBJECT
+	entry bootA
+	stack stackA
+	include "a.o"
+endseg
+beginseg
+	name "b"
+	flags BOOT OBJECT
+	entry bootB
+	stack stackB
+	include "b.o"
+endseg
+beginwave
+	name "first"
+	include "a"
+endwave
+beginwave
+	name "second"
+	include "b"
+endwave
+`
+
+func TestLinkWavesPlacesWavesAndResolvesCrossWaveSymbols(t *testing.T) {
+	assert := assert.New(t)
+	spec, err := ParseSpec(strings.NewReader(twoWaveSpec))
+	if !assert.NoError(err) {
+		return
+	}
+	as := &fakeAs{}
+	ld := &fakeWaveLd{
+		sizes: map[string]uint64{"first": 0x1234, "second": 0x800},
+		refs: map[string][]string{
+			// The first wave loads the second, so it needs its rom range.
+			"first":  {"_secondWaveRomStart", "_secondWaveRomEnd", "_firstWaveRomEnd"},
+			"second": {"_firstWaveRomStart"},
+		},
+		links: map[string]int{},
+	}
+	linked, err := LinkWaves(context.Background(), t.TempDir(), spec, as, ld, nil)
+	if !assert.NoError(err) || !assert.Len(linked, 2) {
+		return
+	}
+
+	assert.Equal(uint64(0x1000), linked[0].RomStart)
+	assert.Equal(uint64(0x2234), linked[0].RomEnd)
+	assert.Equal(uint64(0x2240), linked[1].RomStart)
+	assert.Equal(uint64(0x2a40), linked[1].RomEnd)
+
+	first, err := ReadSymbols(bytes.NewReader(linked[0].Object))
+	assert.NoError(err)
+	assert.Equal(uint64(0x2240), first["_secondWaveRomStart"])
+	assert.Equal(uint64(0x2a40), first["_secondWaveRomEnd"])
+	assert.Equal(uint64(0x2234), first["_firstWaveRomEnd"])
+	second, err := ReadSymbols(bytes.NewReader(linked[1].Object))
+	assert.NoError(err)
+	assert.Equal(uint64(0x1000), second["_firstWaveRomStart"])
+
+	// Only the wave that used placeholders is linked again, and each entry
+	// point is only assembled once.
+	assert.Equal(map[string]int{"first": 2, "second": 1}, ld.links)
+	assert.Equal(2, as.runs)
+}
+
+func TestLinkWavesReportsUndefinedSymbols(t *testing.T) {
+	spec, err := ParseSpec(strings.NewReader(twoWaveSpec))
+	if !assert.NoError(t, err) {
+		return
+	}
+	ld := &fakeWaveLd{
+		sizes: map[string]uint64{"first": 0x100, "second": 0x100},
+		refs:  map[string][]string{"first": {"_thirdWaveRomStart"}},
+		links: map[string]int{},
+	}
+	_, err = LinkWaves(context.Background(), t.TempDir(), spec, &fakeAs{}, ld, nil)
+	var linkErr *LinkError
+	if assert.ErrorAs(t, err, &linkErr) {
+		assert.Equal(t, "first", linkErr.Wave)
+	}
+}